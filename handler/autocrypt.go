@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+	"github.com/lavab/mailer/shared"
+	"golang.org/x/crypto/openpgp"
+)
+
+// updateAutocrypt applies the Autocrypt header of an inbound email to the
+// account's peer states. Autocrypt-Gossip headers are only trustworthy in
+// the encrypted payload, which the mailer can't read, so they're ignored.
+func updateAutocrypt(account *models.Account, email *Message) error {
+	// Reports are never used to update the state
+	if strings.HasPrefix(email.Headers.Get("Content-Type"), "multipart/report") {
+		return nil
+	}
+
+	from, err := email.Headers.AddressList("from")
+	if err != nil || len(from) != 1 {
+		return nil
+	}
+	sender := strings.ToLower(from[0].Address)
+
+	// Effective date of the message can't be in the future
+	date := time.Now()
+	if d, err := email.Headers.Date(); err == nil && d.Before(date) {
+		date = d
+	}
+
+	// Only a single valid header for the sender is accepted
+	var header *shared.AutocryptHeader
+	count := 0
+	for _, value := range email.Headers["Autocrypt"] {
+		h, err := shared.ParseAutocryptHeader(value)
+		if err != nil || h.Address != sender {
+			continue
+		}
+
+		header = h
+		count++
+	}
+	if count > 1 {
+		header = nil
+	}
+
+	peer, err := getAutocryptPeer(account.ID, sender)
+	if err != nil {
+		return err
+	}
+	peer.Update(header, date)
+	return saveAutocryptPeer(peer)
+}
+
+// getAutocryptPeer fetches the account's state of a peer or creates a new one
+func getAutocryptPeer(owner string, address string) (*shared.AutocryptPeer, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("autocrypt_peers").GetAllByIndex("ownerAddress", []interface{}{
+		owner,
+		address,
+	}).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var peers []*shared.AutocryptPeer
+	if err := cursor.All(&peers); err != nil {
+		return nil, err
+	}
+
+	if len(peers) > 0 {
+		return peers[0], nil
+	}
+
+	// IDs are derived from the owner and address, so that concurrent
+	// deliveries update the same peer
+	hash := sha256.Sum256([]byte(owner + "\x00" + address))
+
+	return &shared.AutocryptPeer{
+		Resource: models.Resource{
+			ID:          deterministicID(hash[:]),
+			DateCreated: time.Now(),
+			Owner:       owner,
+		},
+		Address: address,
+	}, nil
+}
+
+func saveAutocryptPeer(peer *shared.AutocryptPeer) error {
+	peer.DateModified = time.Now()
+
+	return gorethink.Db(cfg.RethinkDatabase).Table("autocrypt_peers").Insert(peer, gorethink.InsertOpts{
+		Conflict: "update",
+	}).Exec(session)
+}
+
+// autocryptKeys returns keys passed in Autocrypt headers of an email
+func autocryptKeys(email *Message) openpgp.EntityList {
+	keyring := openpgp.EntityList{}
+
+	for _, value := range email.Headers["Autocrypt"] {
+		header, err := shared.ParseAutocryptHeader(value)
+		if err != nil {
+			continue
+		}
+
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(header.KeyData))
+		if err != nil {
+			continue
+		}
+
+		keyring = append(keyring, entities...)
+	}
+
+	return keyring
+}
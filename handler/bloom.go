@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/utils"
+	"github.com/willf/bloom"
+)
+
+const (
+	// Target false positive rate of the recipient filter
+	recipientFilterRate = 0.001
+
+	// Room for addresses created after the filter was sized
+	recipientFilterSpare = 100000
+
+	// Delay before restarting a failed changefeed
+	recipientFeedRetry = 10 * time.Second
+)
+
+// Tables that hold recipient addresses and the fields with the addresses
+var recipientFilterSources = map[string]string{
+	"addresses":  "id",
+	"aliases":    "address",
+	"groups":     "address",
+	"catch_alls": "id",
+}
+
+// RecipientFilter is an in-process bloom filter of every known address. It
+// tells with certainty that an address doesn't exist, saving a database
+// round-trip on dictionary attacks. It rejects addresses only while every
+// table is synced, ie. its changefeed is live and the table was loaded
+// after the feed had started.
+type RecipientFilter struct {
+	lock      sync.RWMutex
+	filter    *bloom.BloomFilter
+	catchAlls map[string]struct{}
+	synced    map[string]bool
+
+	// Statistics used to measure the false positive rate
+	checks         uint64
+	rejections     uint64
+	falsePositives uint64
+}
+
+// newRecipientFilter creates a filter sized for the current number of
+// addresses. It accepts every address until Watch syncs all tables.
+func newRecipientFilter() (*RecipientFilter, error) {
+	total := 0
+	for table := range recipientFilterSources {
+		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table(table).Count().Run(session)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+		var count int
+		if err := cursor.One(&count); err != nil {
+			return nil, err
+		}
+
+		total += count
+	}
+
+	return &RecipientFilter{
+		filter:    bloom.NewWithEstimates(uint(total*2+recipientFilterSpare), recipientFilterRate),
+		catchAlls: map[string]struct{}{},
+		synced:    map[string]bool{},
+	}, nil
+}
+
+// load adds all existing addresses of the table to the filter
+func (f *RecipientFilter) load(table string) error {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table(table).Field(recipientFilterSources[table]).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var value string
+	for cursor.Next(&value) {
+		f.add(table, value)
+	}
+
+	return cursor.Err()
+}
+
+// Watch keeps the filter up to date using a changefeed of the table. The
+// table is loaded once the feed is live, so that no address created in the
+// meantime is missed. It blocks until the feed fails.
+func (f *RecipientFilter) Watch(table string) error {
+	field := recipientFilterSources[table]
+
+	// Changes after the feed's failure are unknown until it's restarted
+	defer func() {
+		f.lock.Lock()
+		f.synced[table] = false
+		f.lock.Unlock()
+	}()
+
+	// Run returns after the server has confirmed the subscription
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table(table).Changes().Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if err := f.load(table); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.synced[table] = true
+	f.lock.Unlock()
+
+	var change struct {
+		NewVal map[string]interface{} `gorethink:"new_val"`
+		OldVal map[string]interface{} `gorethink:"old_val"`
+	}
+	for cursor.Next(&change) {
+		if value, ok := change.NewVal[field].(string); ok {
+			f.add(table, value)
+		} else if value, ok := change.OldVal[field].(string); ok && table == "catch_alls" {
+			// Bloom filters can't forget, but the catch-all set can
+			f.lock.Lock()
+			delete(f.catchAlls, strings.ToLower(value))
+			f.lock.Unlock()
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (f *RecipientFilter) add(table string, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if table == "catch_alls" {
+		f.catchAlls[strings.ToLower(value)] = struct{}{}
+		return
+	}
+
+	f.filter.AddString(strings.ToLower(value))
+}
+
+// MayExist returns false only if the address certainly doesn't belong to
+// any account. Addresses outside of our domains are left to the resolver.
+// Lookups are counted in the statistics if recordStats is set.
+func (f *RecipientFilter) MayExist(address string, recordStats bool) bool {
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 {
+		return true
+	}
+
+	domain := strings.ToLower(parts[1])
+	if _, ok := domains[domain]; !ok {
+		return true
+	}
+
+	local := parts[0]
+	if i := strings.Index(local, "+"); i != -1 {
+		local = local[:i]
+	}
+	name := utils.RemoveDots(
+		utils.NormalizeUsername(local),
+	)
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for table := range recipientFilterSources {
+		if !f.synced[table] {
+			return true
+		}
+	}
+
+	if recordStats {
+		atomic.AddUint64(&f.checks, 1)
+	}
+
+	if _, ok := f.catchAlls[domain]; ok {
+		return true
+	}
+
+	if f.filter.TestString(name) || f.filter.TestString(name+"@"+domain) {
+		return true
+	}
+
+	if recordStats {
+		atomic.AddUint64(&f.rejections, 1)
+	}
+	return false
+}
+
+// FalsePositive records that an address passed the filter, but wasn't found
+func (f *RecipientFilter) FalsePositive() {
+	atomic.AddUint64(&f.falsePositives, 1)
+}
+
+// Stats returns the number of checks, rejections and the rate of false
+// positives among the addresses that passed the filter.
+func (f *RecipientFilter) Stats() (uint64, uint64, float64) {
+	var (
+		checks         = atomic.LoadUint64(&f.checks)
+		rejections     = atomic.LoadUint64(&f.rejections)
+		falsePositives = atomic.LoadUint64(&f.falsePositives)
+	)
+
+	rate := 0.0
+	if passed := checks - rejections; passed > 0 {
+		rate = float64(falsePositives) / float64(passed)
+	}
+
+	return checks, rejections, rate
+}
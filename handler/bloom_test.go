@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/willf/bloom"
+)
+
+func testRecipientFilter() *RecipientFilter {
+	return &RecipientFilter{
+		filter:    bloom.NewWithEstimates(1000, recipientFilterRate),
+		catchAlls: map[string]struct{}{},
+		synced:    map[string]bool{},
+	}
+}
+
+func TestRecipientFilterWaitsForSync(t *testing.T) {
+	f := testRecipientFilter()
+	f.add("addresses", "alice")
+
+	// Unsynced tables might be missing addresses
+	if !f.MayExist("bob@lavaboom.com", true) {
+		t.Error("Filter rejected an address before all tables were synced")
+	}
+
+	for table := range recipientFilterSources {
+		f.synced[table] = true
+	}
+	if f.MayExist("bob@lavaboom.com", true) {
+		t.Error("Filter accepted an unknown address")
+	}
+	if !f.MayExist("a.lice+tag@lavaboom.com", true) {
+		t.Error("Filter rejected a known address")
+	}
+
+	// A failed feed makes the filter permissive again
+	f.synced["aliases"] = false
+	if !f.MayExist("bob@lavaboom.com", true) {
+		t.Error("Filter rejected an address while a feed was down")
+	}
+}
+
+func TestRecipientFilterStats(t *testing.T) {
+	f := testRecipientFilter()
+	for table := range recipientFilterSources {
+		f.synced[table] = true
+	}
+	f.add("catch_alls", "lavaboom.io")
+
+	f.MayExist("bob@lavaboom.com", true)
+	f.MayExist("bob@lavaboom.io", true)
+	f.MayExist("carol@lavaboom.com", false)
+	f.MayExist("dave@example.com", true)
+
+	checks, rejections, _ := f.Stats()
+	if checks != 2 || rejections != 1 {
+		t.Errorf("Expected 2 checks and 1 rejection, got %d and %d", checks, rejections)
+	}
+}
@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"path"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/models"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/lavab/mailer/shared"
+)
+
+// Prefix of keys set by the mailer in the shared cache
+const cachePrefix = "mailer:"
+
+// Number of entries kept by in-memory caches
+const memoryCacheSize = 10000
+
+// errCacheMiss is returned by MemoryCache for missing and expired keys
+var errCacheMiss = errors.New("Cache miss")
+
+var (
+	// lookupCache holds address owners and accounts. It's shared using Redis
+	// if it's available.
+	lookupCache cache.Cache
+
+	// keyringCache holds parsed public keys, which can't be serialized
+	keyringCache = NewMemoryCache(memoryCacheSize)
+)
+
+// MemoryCache is an in-process LRU implementation of cache.Cache. Values
+// are stored as they are, so Get has to be passed a pointer to the type of
+// the stored value.
+type MemoryCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewMemoryCache creates a cache holding at most size entries
+func NewMemoryCache(size int) *MemoryCache {
+	return &MemoryCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Get copies the value into the pointer
+func (c *MemoryCache) Get(key string, pointer interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return errCacheMiss
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		return errCacheMiss
+	}
+
+	target := reflect.ValueOf(pointer)
+	value := reflect.ValueOf(entry.value)
+	if target.Kind() != reflect.Ptr || !value.Type().AssignableTo(target.Elem().Type()) {
+		return errors.New("Invalid type of the cache target")
+	}
+	target.Elem().Set(value)
+
+	c.order.MoveToFront(element)
+	return nil
+}
+
+// Set stores the value, evicting the least recently used entry if needed
+func (c *MemoryCache) Set(key string, value interface{}, expires time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &memoryCacheEntry{
+		key:   key,
+		value: value,
+	}
+	if expires != 0 {
+		entry.expires = time.Now().Add(expires)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return nil
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+
+	return nil
+}
+
+// Delete removes the key
+func (c *MemoryCache) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	return nil
+}
+
+// DeleteMask removes keys matching the glob pattern
+func (c *MemoryCache) DeleteMask(mask string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, element := range c.entries {
+		if matched, _ := path.Match(mask, key); matched {
+			c.remove(element)
+		}
+	}
+
+	return nil
+}
+
+// DeleteMulti removes every passed key
+func (c *MemoryCache) DeleteMulti(keys ...interface{}) error {
+	for _, key := range keys {
+		if key, ok := key.(string); ok {
+			c.Delete(key)
+		}
+	}
+
+	return nil
+}
+
+// Exists checks whether the key is stored and didn't expire
+func (c *MemoryCache) Exists(key string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	return entry.expires.IsZero() || time.Now().Before(entry.expires), nil
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*memoryCacheEntry).key)
+	c.order.Remove(element)
+}
+
+// CacheEvent is published on the account_changed, key_changed and
+// address_changed topics to invalidate cached lookups.
+type CacheEvent struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// invalidateCache removes entries affected by an event on the topic
+func invalidateCache(topic string, body []byte) error {
+	var event *CacheEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return err
+	}
+	if event == nil {
+		return errors.New("Invalid cache event")
+	}
+
+	switch topic {
+	case "account_changed":
+		if err := lookupCache.Delete(cachePrefix + "account:" + event.ID); err != nil {
+			return err
+		}
+		if err := lookupCache.Delete(cachePrefix + "spam:" + event.ID); err != nil {
+			return err
+		}
+		return keyringCache.Delete(cachePrefix + "keys:" + event.ID)
+	case "key_changed":
+		return keyringCache.Delete(cachePrefix + "keys:" + event.Owner)
+	case "address_changed":
+		return lookupCache.Delete(cachePrefix + "address:" + event.ID)
+	}
+
+	return nil
+}
+
+// getAddressOwner returns ID of the account owning the address name or an
+// empty string if there's no such address.
+func getAddressOwner(name string) (string, error) {
+	var owner string
+	if err := lookupCache.Get(cachePrefix+"address:"+name, &owner); err == nil {
+		return owner, nil
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("addresses").Get(name).Run(session)
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+	var mapping *models.Address
+	if err := cursor.One(&mapping); err != nil && err != gorethink.ErrEmptyResult {
+		return "", err
+	}
+
+	// Missing addresses aren't cached, so that new ones work right away
+	if mapping == nil {
+		return "", nil
+	}
+
+	lookupCache.Set(cachePrefix+"address:"+name, mapping.Owner, cfg.CacheExpiry)
+	return mapping.Owner, nil
+}
+
+// getAccounts fetches accounts by their IDs. Missing accounts are skipped.
+func getAccounts(ids []interface{}) ([]*models.Account, error) {
+	var (
+		accounts = []*models.Account{}
+		missing  = []interface{}{}
+	)
+	for _, id := range ids {
+		var (
+			data    []byte
+			account *models.Account
+		)
+		if err := lookupCache.Get(cachePrefix+"account:"+id.(string), &data); err == nil && json.Unmarshal(data, &account) == nil && account != nil {
+			accounts = append(accounts, account)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return accounts, nil
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("accounts").GetAll(missing...).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var fetched []*models.Account
+	if err := cursor.All(&fetched); err != nil {
+		return nil, err
+	}
+
+	// Accounts are cached as JSON, which also leaves out their secrets
+	for _, account := range fetched {
+		if data, err := json.Marshal(account); err == nil {
+			lookupCache.Set(cachePrefix+"account:"+account.ID, data, cfg.CacheExpiry)
+		}
+	}
+
+	return append(accounts, fetched...), nil
+}
+
+// getAccountKeys returns every currently valid encryption key of the account
+func getAccountKeys(account *models.Account) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	if err := keyringCache.Get(cachePrefix+"keys:"+account.ID, &keyring); err == nil {
+		return keyring, nil
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("keys").GetAllByIndex("owner", account.ID).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var keys []*models.Key
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	keyring = shared.EncryptionKeys(keys)
+	if len(keyring) == 0 {
+		return nil, errNoUsableKey
+	}
+
+	keyringCache.Set(cachePrefix+"keys:"+account.ID, keyring, cfg.CacheExpiry)
+	return keyring, nil
+}
@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+
+	"github.com/lavab/mailer/shared"
+)
+
+// threadState is the part of a thread that label counters depend on
+type threadState struct {
+	Labels []string `gorethink:"labels"`
+	IsRead bool     `gorethink:"is_read"`
+}
+
+// writeThread runs a write query on the threads table and applies its
+// changes to the counters of affected labels. The query has to return
+// changes. The thread and the counters are written by separate queries, so
+// a failure between them leaves the counters off. Retries can't tell that,
+// as the thread is already up to date, and only -repair_label_counters
+// fixes such drift.
+func writeThread(query gorethink.Term) error {
+	cursor, err := query.Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var response struct {
+		Changes []struct {
+			OldVal *threadState `gorethink:"old_val"`
+			NewVal *threadState `gorethink:"new_val"`
+		} `gorethink:"changes"`
+	}
+	if err := cursor.One(&response); err != nil {
+		return err
+	}
+
+	for _, change := range response.Changes {
+		if err := updateLabelCounters(change.OldVal, change.NewVal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateLabelCounters adjusts counters of labels by the difference between
+// two states of a thread. Every label is updated atomically, but not all of
+// them at once. Nil states stand for threads that don't exist.
+func updateLabelCounters(old *threadState, new *threadState) error {
+	type delta struct {
+		total  int
+		unread int
+	}
+	deltas := map[string]*delta{}
+
+	apply := func(state *threadState, sign int) {
+		if state == nil {
+			return
+		}
+
+		for _, label := range state.Labels {
+			if _, ok := deltas[label]; !ok {
+				deltas[label] = &delta{}
+			}
+
+			deltas[label].total += sign
+			if !state.IsRead {
+				deltas[label].unread += sign
+			}
+		}
+	}
+	apply(old, -1)
+	apply(new, 1)
+
+	for label, delta := range deltas {
+		if delta.total == 0 && delta.unread == 0 {
+			continue
+		}
+
+		if err := gorethink.Db(cfg.RethinkDatabase).Table("labels").Get(label).Update(map[string]interface{}{
+			"total_threads_count":  gorethink.Row.Field("total_threads_count").Default(0).Add(delta.total),
+			"unread_threads_count": gorethink.Row.Field("unread_threads_count").Default(0).Add(delta.unread),
+		}).Exec(session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RepairLabelCounters recomputes counters of every label from the threads
+// table, fixing drift caused by changes made outside of the mailer and by
+// failures between thread and counter writes.
+func RepairLabelCounters(config *shared.Flags) error {
+	cfg = config
+
+	var err error
+	session, err = gorethink.Connect(gorethink.ConnectOpts{
+		Address: config.RethinkAddress,
+		AuthKey: config.RethinkKey,
+		MaxIdle: 10,
+		Timeout: time.Second * 10,
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("accounts").Pluck("id").Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var accounts []*models.Account
+	if err := cursor.All(&accounts); err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		if err := repairAccountLabelCounters(account.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func repairAccountLabelCounters(owner string) error {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("threads").GetAllByIndex("owner", owner).Pluck("labels", "is_read").Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var threads []*threadState
+	if err := cursor.All(&threads); err != nil {
+		return err
+	}
+
+	var (
+		total  = map[string]int{}
+		unread = map[string]int{}
+	)
+	for _, thread := range threads {
+		for _, label := range thread.Labels {
+			total[label]++
+			if !thread.IsRead {
+				unread[label]++
+			}
+		}
+	}
+
+	cursor, err = gorethink.Db(cfg.RethinkDatabase).Table("labels").GetAllByIndex("owner", owner).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var labels []*models.Label
+	if err := cursor.All(&labels); err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		if label.TotalThreadsCount == total[label.ID] && label.UnreadThreadsCount == unread[label.ID] {
+			continue
+		}
+
+		if err := gorethink.Db(cfg.RethinkDatabase).Table("labels").Get(label.ID).Update(map[string]interface{}{
+			"total_threads_count":  total[label.ID],
+			"unread_threads_count": unread[label.ID],
+		}).Exec(session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
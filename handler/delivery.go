@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/api/models"
+)
+
+const (
+	// Deliveries that weren't touched for this long are considered failed.
+	// It has to exceed the time for which MTAs and the spool retry emails,
+	// usually up to 5 days.
+	deliveryGCAfter = 6 * 24 * time.Hour
+
+	// Deliveries are remembered for this long to recognize retries
+	deliveryRetention = 7 * 24 * time.Hour
+)
+
+// processingKey derives a deterministic key of an envelope from its data
+// and recipients, so that retries of the same envelope get the same key.
+// Our own Received line differs between attempts, so it's left out.
+func processingKey(data []byte, recipients []string) string {
+	data = skipHeaderField(data)
+
+	sorted := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		sorted[i] = strings.ToLower(recipient)
+	}
+	sort.Strings(sorted)
+
+	hash := sha256.New()
+	hash.Write(data)
+	for _, recipient := range sorted {
+		hash.Write([]byte{0})
+		hash.Write([]byte(recipient))
+	}
+
+	return deterministicID(hash.Sum(nil))
+}
+
+// processingID derives a deterministic ID of a row created while processing
+// an envelope, so that retries replace rows instead of duplicating them.
+func processingID(key string, parts ...string) string {
+	hash := sha256.New()
+	hash.Write([]byte(key))
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+
+	return deterministicID(hash.Sum(nil))
+}
+
+// deterministicID encodes a hash to an ID looking like the random ones
+func deterministicID(hash []byte) string {
+	id := make([]byte, uniuri.UUIDLen)
+	for i := range id {
+		id[i] = uniuri.StdChars[int(hash[i])%len(uniuri.StdChars)]
+	}
+
+	return string(id)
+}
+
+// startDelivery fetches the progress of processing an envelope, creating
+// the record on the first attempt.
+func startDelivery(key string) (*Delivery, error) {
+	if err := gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Insert(map[string]interface{}{
+		"id":            key,
+		"date_created":  gorethink.Now(),
+		"date_modified": gorethink.Now(),
+	}, gorethink.InsertOpts{
+		Conflict: "update",
+	}).Exec(session); err != nil {
+		return nil, err
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Get(key).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var delivery *Delivery
+	if err := cursor.One(&delivery); err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+// recordDeliveryFile remembers a file inserted for an account, so that it
+// can be removed if the account's delivery never completes.
+func recordDeliveryFile(key string, owner string, id string) error {
+	return gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Get(key).Update(map[string]interface{}{
+		"files": gorethink.Row.Field("files").Default([]interface{}{}).SetInsert(map[string]interface{}{
+			"id":    id,
+			"owner": owner,
+		}),
+		"date_modified": gorethink.Now(),
+	}).Exec(session)
+}
+
+// completeDelivery marks the envelope as delivered to the account
+func completeDelivery(key string, owner string) error {
+	return gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Get(key).Update(map[string]interface{}{
+		"completed":     gorethink.Row.Field("completed").Default([]interface{}{}).SetInsert(owner),
+		"date_modified": gorethink.Now(),
+	}).Exec(session)
+}
+
+// recordForward marks the envelope as forwarded by the account or relayed
+// to the SRS address
+func recordForward(key string, id string) error {
+	return gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Get(key).Update(map[string]interface{}{
+		"forwarded":     gorethink.Row.Field("forwarded").Default([]interface{}{}).SetInsert(id),
+		"date_modified": gorethink.Now(),
+	}).Exec(session)
+}
+
+// collectDeliveries removes files of deliveries that failed and weren't
+// retried, and forgets deliveries past the retention period. Files are kept
+// if the account's email got inserted, even if the delivery didn't finish.
+func collectDeliveries() error {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Filter(func(row gorethink.Term) gorethink.Term {
+		return row.Field("date_modified").Lt(gorethink.Now().Sub(deliveryGCAfter.Seconds()))
+	}).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var deliveries []*Delivery
+	if err := cursor.All(&deliveries); err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		completed := map[string]struct{}{}
+		for _, owner := range delivery.Completed {
+			completed[owner] = struct{}{}
+		}
+
+		// Files of incomplete deliveries are orphaned only if the email
+		// itself wasn't inserted
+		orphans := []interface{}{}
+		for _, file := range delivery.Files {
+			if _, ok := completed[file.Owner]; ok {
+				continue
+			}
+
+			inserted, err := isEmailInserted(delivery.ID, file.Owner)
+			if err != nil {
+				return err
+			}
+			if inserted {
+				completed[file.Owner] = struct{}{}
+				continue
+			}
+
+			orphans = append(orphans, file.ID)
+		}
+		if len(orphans) > 0 {
+			if err := removeOrphanedFiles(orphans); err != nil {
+				return err
+			}
+		}
+
+		if time.Since(delivery.DateCreated) > deliveryRetention {
+			if err := gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Get(delivery.ID).Delete().Exec(session); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(delivery.Files) > 0 {
+			if err := gorethink.Db(cfg.RethinkDatabase).Table("deliveries").Get(delivery.ID).Update(map[string]interface{}{
+				"files": []interface{}{},
+			}).Exec(session); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isEmailInserted checks whether the account's email was inserted while
+// processing the envelope
+func isEmailInserted(key string, owner string) (bool, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("emails").Get(processingID(key, owner, "email")).Run(session)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+	var email map[string]interface{}
+	if err := cursor.One(&email); err == gorethink.ErrEmptyResult {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return email != nil, nil
+}
+
+// removeOrphanedFiles deletes the files and gives back the storage that
+// they were charged for
+func removeOrphanedFiles(ids []interface{}) error {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("files").GetAll(ids...).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var files []*models.File
+	if err := cursor.All(&files); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		result, err := gorethink.Db(cfg.RethinkDatabase).Table("files").Get(file.ID).Delete().RunWrite(session)
+		if err != nil {
+			return err
+		}
+
+		// Only the collector that deleted the file gives the storage back
+		if result.Deleted > 0 {
+			if err := addUsage(file.Owner, 0, -len(file.Data)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// skipHeaderField removes the first header field, including its
+// continuation lines
+func skipHeaderField(data []byte) []byte {
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\n' {
+			continue
+		}
+
+		if i+1 < len(data) && (data[i+1] == ' ' || data[i+1] == '\t') {
+			continue
+		}
+
+		return data[i+1:]
+	}
+
+	return data
+}
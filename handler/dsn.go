@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/bitly/go-nsq"
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+)
+
+// Prefix of plus-addressing tags that carry IDs of sent emails (VERP)
+const verpPrefix = "bounce-"
+
+// RecipientStatus is a per-recipient part of a delivery status notification
+type RecipientStatus struct {
+	Recipient      string `json:"recipient" gorethink:"recipient"`
+	Action         string `json:"action" gorethink:"action"`
+	Status         string `json:"status" gorethink:"status"`
+	DiagnosticCode string `json:"diagnostic_code,omitempty" gorethink:"diagnostic_code,omitempty"`
+}
+
+// Failed tells whether the delivery to the recipient has permanently failed
+func (r *RecipientStatus) Failed() bool {
+	return strings.EqualFold(r.Action, "failed") || strings.HasPrefix(r.Status, "5.")
+}
+
+// isDSN checks whether the email is a delivery status notification (RFC 3464)
+func isDSN(email *Message) bool {
+	mediaType, params, err := mime.ParseMediaType(email.Headers.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status")
+}
+
+// parseDSN returns per-recipient statuses of a DSN and the Message-ID of the
+// original email, if the DSN includes its headers.
+func parseDSN(email *Message) ([]*RecipientStatus, string) {
+	var (
+		statuses  = []*RecipientStatus{}
+		messageID string
+	)
+
+	for _, child := range email.Children {
+		mediaType, _, err := mime.ParseMediaType(child.Headers.Get("Content-Type"))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "message/delivery-status":
+			// Per-message fields are followed by blocks of per-recipient fields
+			blocks := strings.Split(strings.Replace(string(child.Body), "\r\n", "\n", -1), "\n\n")
+			for i, block := range blocks {
+				if i == 0 || strings.TrimSpace(block) == "" {
+					continue
+				}
+
+				fields, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.TrimSpace(block) + "\n\n"))).ReadMIMEHeader()
+				if err != nil {
+					continue
+				}
+
+				recipient := fields.Get("Final-Recipient")
+				if recipient == "" {
+					recipient = fields.Get("Original-Recipient")
+				}
+				if recipient == "" {
+					continue
+				}
+
+				statuses = append(statuses, &RecipientStatus{
+					Recipient:      stripAddressType(recipient),
+					Action:         strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+					Status:         strings.TrimSpace(fields.Get("Status")),
+					DiagnosticCode: stripAddressType(fields.Get("Diagnostic-Code")),
+				})
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			original, err := mail.ReadMessage(bytes.NewReader(append(child.Body, "\r\n\r\n"...)))
+			if err != nil {
+				continue
+			}
+
+			messageID = strings.Trim(strings.TrimSpace(original.Header.Get("Message-ID")), "<>")
+		}
+	}
+
+	return statuses, messageID
+}
+
+// handleDSN marks emails sent by the account as bounced if the DSN reports
+// failures. IDs are the email IDs passed using VERP. Returns true if any
+// email was marked.
+func handleDSN(producer *nsq.Producer, account *models.Account, email *Message, ids []string) (bool, error) {
+	statuses, messageID := parseDSN(email)
+
+	failed := []*RecipientStatus{}
+	for _, status := range statuses {
+		if status.Failed() {
+			failed = append(failed, status)
+		}
+	}
+	if len(failed) == 0 {
+		return false, nil
+	}
+
+	// Find the original emails, by VERP and by the Message-ID
+	originals := []*models.Email{}
+	for _, id := range ids {
+		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("emails").Get(id).Run(session)
+		if err != nil {
+			return false, err
+		}
+		var original *models.Email
+		err = cursor.One(&original)
+		cursor.Close()
+		if err != nil && err != gorethink.ErrEmptyResult {
+			return false, err
+		}
+
+		// VERP addresses can be forged, so the owner has to match
+		if original != nil && original.Owner == account.ID {
+			originals = append(originals, original)
+		}
+	}
+	if len(originals) == 0 && messageID != "" {
+		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("emails").GetAllByIndex("messageIDOwner", []interface{}{
+			messageID,
+			account.ID,
+		}).Run(session)
+		if err != nil {
+			return false, err
+		}
+		defer cursor.Close()
+		if err := cursor.All(&originals); err != nil {
+			return false, err
+		}
+	}
+
+	marked := false
+	for _, original := range originals {
+		// Received emails can't bounce
+		if original.Status == "received" {
+			continue
+		}
+
+		if err := gorethink.Db(cfg.RethinkDatabase).Table("emails").Get(original.ID).Update(map[string]interface{}{
+			"status":          "bounced",
+			"delivery_status": failed,
+			"date_modified":   gorethink.Now(),
+		}).Exec(session); err != nil {
+			return false, err
+		}
+
+		notification, err := json.Marshal(map[string]interface{}{
+			"id":         original.ID,
+			"owner":      account.ID,
+			"recipients": failed,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if err := producer.Publish("email_bounced", notification); err != nil {
+			return false, err
+		}
+
+		marked = true
+	}
+
+	return marked, nil
+}
+
+// stripAddressType removes the type prefix of DSN fields, such as "rfc822;"
+func stripAddressType(value string) string {
+	if i := strings.Index(value, ";"); i != -1 {
+		value = value[i+1:]
+	}
+
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/lavab/mailer/shared"
+)
+
+// Compares encrypting the body separately for every recipient, so that no
+// recipient learns the others' keys, with a single message for all of them.
+func BenchmarkEncryptRecipients(b *testing.B) {
+	body := bytes.Repeat([]byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\r\n"), 1000)
+
+	keyring := openpgp.EntityList{}
+	for i := 0; i < 20; i++ {
+		entity, err := openpgp.NewEntity("recipient", "", "recipient"+strconv.Itoa(i)+"@lavaboom.com", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// Without preferences openpgp picks RIPEMD-160, which isn't linked in
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+		}
+
+		keyring = append(keyring, entity)
+	}
+
+	for _, n := range []int{1, 5, 20} {
+		recipients := keyring[:n]
+
+		b.Run("PerRecipient/"+strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(len(body) * n))
+			for i := 0; i < b.N; i++ {
+				for _, recipient := range recipients {
+					if _, err := shared.EncryptAndArmor(body, openpgp.EntityList{recipient}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run("Combined/"+strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(len(body) * n))
+			for i := 0; i < b.N; i++ {
+				if _, err := shared.EncryptAndArmor(body, recipients); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
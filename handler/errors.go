@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/lavab/smtpd"
+)
+
+// errorKind classifies handler failures, each kind maps to an SMTP reply
+type errorKind int
+
+const (
+	// Outages of RethinkDB, NSQ or other backends
+	kindTemporary errorKind = iota
+
+	// Recipients that don't map to any account
+	kindUnknownUser
+
+	// Emails that can't be parsed
+	kindInvalidContent
+
+	// Emails rejected by a policy, such as relaying or group restrictions
+	kindPolicy
+
+	// Recipients over their storage quota
+	kindMailboxFull
+
+	// Recipients without a usable encryption key
+	kindMissingKey
+
+	// Groups that expand too deep or to too many members
+	kindGroupLimit
+)
+
+// Replies of error kinds. Messages of temporary errors are replaced with a
+// generic one, as they may contain internal details.
+var errorReplies = map[errorKind]smtpd.Error{
+	kindTemporary:      {Code: 451, Message: "4.3.0 Temporary failure"},
+	kindUnknownUser:    {Code: 550, Message: "5.1.1"},
+	kindInvalidContent: {Code: 554, Message: "5.6.0"},
+	kindPolicy:         {Code: 550, Message: "5.7.1"},
+	kindMailboxFull:    {Code: 452, Message: "4.2.2"},
+	kindMissingKey:     {Code: 450, Message: "4.7.0"},
+	kindGroupLimit:     {Code: 550, Message: "5.4.6"},
+}
+
+// handlerError is a failure of the handler along with the place that it
+// happened at, which is logged but never sent to the client.
+type handlerError struct {
+	kind errorKind
+	err  error
+	file string
+	line int
+}
+
+func (e *handlerError) Error() string {
+	return fmt.Sprintf("%s:%d - %s", e.file, e.line, e.err.Error())
+}
+
+// Reply returns the SMTP reply sent to the client
+func (e *handlerError) Reply() smtpd.Error {
+	reply := errorReplies[e.kind]
+	if e.kind != kindTemporary {
+		reply.Message += " " + e.err.Error()
+	}
+
+	return reply
+}
+
+func newHandlerError(kind errorKind, err error) error {
+	_, file, line, _ := runtime.Caller(2)
+	return &handlerError{
+		kind: kind,
+		err:  err,
+		file: file,
+		line: line,
+	}
+}
+
+// describeError wraps an unexpected error, such as a backend outage
+func describeError(err error) error {
+	return newHandlerError(kindTemporary, err)
+}
+
+// unknownUserError wraps an error caused by an unknown recipient
+func unknownUserError(err error) error {
+	return newHandlerError(kindUnknownUser, err)
+}
+
+// contentError wraps an error caused by an unparseable email
+func contentError(err error) error {
+	return newHandlerError(kindInvalidContent, err)
+}
+
+// policyError wraps a rejection by a policy
+func policyError(err error) error {
+	return newHandlerError(kindPolicy, err)
+}
+
+// mailboxFullError wraps a rejection caused by an exceeded quota
+func mailboxFullError(err error) error {
+	return newHandlerError(kindMailboxFull, err)
+}
+
+// missingKeyError wraps a rejection caused by a recipient without a key
+func missingKeyError(err error) error {
+	return newHandlerError(kindMissingKey, err)
+}
+
+// groupLimitError wraps a rejection caused by an oversized group
+func groupLimitError(err error) error {
+	return newHandlerError(kindGroupLimit, err)
+}
+
+// replyError converts an error returned by the handler to an SMTP reply
+func replyError(err error) smtpd.Error {
+	switch err := err.(type) {
+	case smtpd.Error:
+		return err
+	case *handlerError:
+		return err.Reply()
+	}
+
+	return errorReplies[kindTemporary]
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+)
+
+// getActiveFilter returns the account's active Sieve script or nil if the
+// account has none.
+func getActiveFilter(account *models.Account) (*Filter, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("filters").GetAllByIndex("owner", account.ID).Filter(map[string]interface{}{
+		"active": true,
+	}).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var filters []*Filter
+	if err := cursor.All(&filters); err != nil {
+		return nil, err
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	return filters[0], nil
+}
+
+// getFilterLabels resolves names used in fileinto actions into label IDs,
+// creating labels that don't exist yet.
+func getFilterLabels(account *models.Account, names []string) ([]string, error) {
+	ids := []string{}
+
+	for _, name := range names {
+		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("labels").GetAllByIndex("nameOwnerBuiltin", []interface{}{
+			name,
+			account.ID,
+			true,
+		}, []interface{}{
+			name,
+			account.ID,
+			false,
+		}).Run(session)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+		var labels []*models.Label
+		if err := cursor.All(&labels); err != nil {
+			return nil, err
+		}
+
+		if len(labels) > 0 {
+			ids = append(ids, labels[0].ID)
+			continue
+		}
+
+		label := &models.Label{
+			Resource: models.MakeResource(account.ID, name),
+		}
+		if err := gorethink.Db(cfg.RethinkDatabase).Table("labels").Insert(label).Exec(session); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, label.ID)
+	}
+
+	return ids, nil
+}
+
+// getTagLabels resolves plus-addressing tags into IDs of the account's own
+// labels. Tags are chosen by the senders, so they never create labels nor
+// apply builtin ones.
+func getTagLabels(account *models.Account, tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return []string{}, nil
+	}
+
+	keys := []interface{}{}
+	for _, tag := range tags {
+		keys = append(keys, []interface{}{
+			tag,
+			account.ID,
+			false,
+		})
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("labels").GetAllByIndex("nameOwnerBuiltin", keys...).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var labels []*models.Label
+	if err := cursor.All(&labels); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, label := range labels {
+		ids = append(ids, label.ID)
+	}
+
+	return ids, nil
+}
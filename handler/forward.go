@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"net/smtp"
+	"strings"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+)
+
+// Trace header added to forwarded emails, used to detect forwarding loops
+const forwardedHeader = "X-Lavaboom-Forwarded"
+
+// Maximal number of times an email can be forwarded by us
+const maxForwardHops = 5
+
+// getForward returns the account's active forwarding rule or nil if the
+// account has none.
+func getForward(account *models.Account) (*Forward, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("forwards").GetAllByIndex("owner", account.ID).Filter(map[string]interface{}{
+		"enabled": true,
+	}).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var forwards []*Forward
+	if err := cursor.All(&forwards); err != nil {
+		return nil, err
+	}
+
+	if len(forwards) == 0 {
+		return nil, nil
+	}
+
+	return forwards[0], nil
+}
+
+// isForwardingLoop checks whether the email has already been forwarded from
+// passed address or went through too many forwards.
+func isForwardingLoop(email *Message, address string) bool {
+	values := email.Headers[forwardedHeader]
+	if len(values) >= maxForwardHops {
+		return true
+	}
+
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardEmail relays an email received at address to the target through the
+// outbound relay. The envelope sender is rewritten using SRS.
+func forwardEmail(data []byte, sender string, address string, target string) error {
+	from := ""
+	if sender != "" {
+		var err error
+		from, err = srs.Forward(sender, address[strings.LastIndex(address, "@")+1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Prepend our trace header
+	data = append([]byte(forwardedHeader+": "+address+"\r\n"), data...)
+
+	return smtp.SendMail(cfg.SMTPAddress, nil, from, []string{target}, data)
+}
+
+// relayBounce routes an email sent to an SRS address back to the original
+// sender of the forwarded email.
+func relayBounce(data []byte, address string) error {
+	original, err := srs.Reverse(address)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(cfg.SMTPAddress, nil, "", []string{original}, data)
+}
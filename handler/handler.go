@@ -3,13 +3,15 @@ package handler
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io/ioutil"
 	"mime"
 	"net/mail"
-	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,10 +21,11 @@ import (
 	"github.com/blang/semver"
 	"github.com/dancannon/gorethink"
 	"github.com/dchest/uniuri"
+	"github.com/lavab/api/cache"
 	"github.com/lavab/api/models"
-	"github.com/lavab/api/utils"
 	"github.com/lavab/go-spamc"
 	"github.com/lavab/mailer/shared"
+	"github.com/lavab/mailer/sieve"
 	man "github.com/lavab/pgp-manifest-go"
 	"github.com/lavab/smtpd"
 	"github.com/lavab/webhook/events"
@@ -36,11 +39,15 @@ var domains = map[string]struct{}{
 }
 
 var (
-	cfg     *shared.Flags
-	session *gorethink.Session
+	cfg             *shared.Flags
+	session         *gorethink.Session
+	srs             *shared.SRS
+	recipientFilter *RecipientFilter
 )
 
-func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelope) error {
+// PrepareHandler returns the handler of inbound emails and NSQ clients that
+// have to be stopped on shutdown.
+func PrepareHandler(config *shared.Flags) (func(peer smtpd.Peer, env smtpd.Envelope) error, *shared.NSQClients) {
 	cfg = config
 
 	// Initialize a new logger
@@ -55,6 +62,32 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 	log.Level = logrus.DebugLevel
 
+	// Prepare the sender rewriting scheme used for forwarding. Without a
+	// secret anyone could forge SRS addresses and relay through us.
+	if config.SRSSecret != "" {
+		srs = &shared.SRS{
+			Secret: []byte(config.SRSSecret),
+			MaxAge: config.SRSMaxAge,
+		}
+	} else {
+		log.Warn("SRS secret is not set, forwarding is disabled")
+	}
+
+	// Load roots trusted to issue S/MIME certificates
+	if config.SMIMERoots != "" {
+		bundle, err := ioutil.ReadFile(config.SMIMERoots)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Fatal("Unable to read S/MIME roots")
+		}
+
+		smimeRoots = x509.NewCertPool()
+		if !smimeRoots.AppendCertsFromPEM(bundle) {
+			log.Fatal("S/MIME roots bundle contains no certificates")
+		}
+	}
+
 	// Initialize the database connection
 	var err error
 	session, err = gorethink.Connect(gorethink.ConnectOpts{
@@ -69,6 +102,86 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 		}).Fatal("Unable to connect to RethinkDB")
 	}
 
+	// Create mailer's own tables
+	setupTables()
+
+	// Cache lookups in Redis, or in memory if it's unavailable
+	lookupCache = NewMemoryCache(memoryCacheSize)
+	if config.RedisAddress != "" {
+		redisCache, err := cache.NewRedisCache(&cache.RedisCacheOpts{
+			Address:  config.RedisAddress,
+			Database: config.RedisDatabase,
+			Password: config.RedisPassword,
+		})
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Warn("Unable to connect to Redis, falling back to an in-memory cache")
+		} else {
+			lookupCache = redisCache
+		}
+	}
+
+	// Reject unknown recipients without querying the database
+	filter, err := newRecipientFilter()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to create the recipient filter")
+	} else {
+		// Each feed loads its table once it's live and again after restarts
+		for table := range recipientFilterSources {
+			go func(table string) {
+				for {
+					if err := filter.Watch(table); err != nil {
+						log.WithFields(logrus.Fields{
+							"error": err.Error(),
+							"table": table,
+						}).Warn("Recipient filter's changefeed failed")
+					}
+					time.Sleep(recipientFeedRetry)
+				}
+			}(table)
+		}
+
+		recipientFilter = filter
+
+		go func() {
+			for range time.Tick(time.Hour) {
+				checks, rejections, rate := filter.Stats()
+				log.WithFields(logrus.Fields{
+					"checks":              checks,
+					"rejections":          rejections,
+					"false_positive_rate": rate,
+				}).Info("Recipient filter statistics")
+			}
+		}()
+	}
+
+	// Periodically remove files of failed deliveries
+	go func() {
+		for range time.Tick(deliveryGCAfter) {
+			if err := collectDeliveries(); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Warn("Unable to collect failed deliveries")
+			}
+		}
+	}()
+
+	// Periodically recompute storage usage of accounts
+	if config.UsageReconcileInterval > 0 {
+		go func() {
+			for range time.Tick(config.UsageReconcileInterval) {
+				if err := reconcileUsage(); err != nil {
+					log.WithFields(logrus.Fields{
+						"error": err.Error(),
+					}).Warn("Unable to reconcile storage usage")
+				}
+			}
+		}()
+	}
+
 	// Connect to NSQ
 	producer, err := nsq.NewProducer(config.NSQDAddress, nsq.NewConfig())
 	if err != nil {
@@ -76,123 +189,382 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 			"error": err.Error(),
 		}).Fatal("Unable to connect to NSQd")
 	}
+	clients := &shared.NSQClients{
+		Producers: []*nsq.Producer{producer},
+	}
+
+	// Drop cached lookups once accounts, keys or addresses change. Every
+	// instance needs its own channel to receive all events.
+	for _, topic := range []string{"account_changed", "key_changed", "address_changed"} {
+		consumer, err := nsq.NewConsumer(topic, "mailer_"+uniuri.NewLen(8)+"#ephemeral", nsq.NewConfig())
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"topic": topic,
+			}).Fatal("Unable to create a consumer")
+		}
+
+		topic := topic
+		consumer.AddHandler(nsq.HandlerFunc(func(msg *nsq.Message) error {
+			if err := invalidateCache(topic, msg.Body); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+					"topic": topic,
+				}).Warn("Unable to invalidate the cache")
+			}
+			return nil
+		}))
+
+		if err := consumer.ConnectToNSQLookupd(config.LookupdAddress); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Fatal("Unable to connect to nsqlookupd")
+		}
+		clients.Consumers = append(clients.Consumers, consumer)
+	}
 
 	// Create a new spamd client
-	spam := spamc.New(config.SpamdAddress, 10)
+	spam := spamc.New(config.SpamdAddress, int((config.SpamdTimeout+time.Second-1)/time.Second))
+	spamChecker := &SpamChecker{
+		Client:  spam,
+		Timeout: config.SpamdTimeout,
+	}
 
-	// Last message sent by PrepareHandler
-	log.WithFields(logrus.Fields{
-		"addr": config.BindAddress,
-	}).Info("Listening for incoming traffic")
+	// Train spamd when users move threads to or from Spam
+	if config.SpamTrainingSecret != "" {
+		for topic, class := range map[string]string{
+			"spam_marked": trainingSpam,
+			"ham_marked":  trainingHam,
+		} {
+			consumer, err := nsq.NewConsumer(topic, "mailer", nsq.NewConfig())
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+					"topic": topic,
+				}).Fatal("Unable to create a consumer")
+			}
+
+			class := class
+			consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(msg *nsq.Message) error {
+				request, err := parseTrainingRequest(msg.Body)
+				if err != nil {
+					// Retrying won't fix a malformed message
+					log.WithFields(logrus.Fields{
+						"error": err.Error(),
+					}).Warn("Dropping an invalid training request")
+					return nil
+				}
 
-	return func(peer smtpd.Peer, e smtpd.Envelope) error {
+				trained, err := trainSpam(spam, class, request)
+				if err != nil {
+					log.WithFields(logrus.Fields{
+						"error": err.Error(),
+						"owner": request.Owner,
+					}).Warn("Unable to train spamd")
+					return err
+				}
+
+				log.WithFields(logrus.Fields{
+					"owner":   request.Owner,
+					"class":   class,
+					"trained": trained,
+				}).Info("Trained spamd")
+				return nil
+			}), 4)
+
+			if err := consumer.ConnectToNSQLookupd(config.LookupdAddress); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Fatal("Unable to connect to nsqlookupd")
+			}
+			clients.Consumers = append(clients.Consumers, consumer)
+		}
+
+		// Periodically remove expired training copies
+		go func() {
+			for range time.Tick(time.Hour) {
+				if err := collectTrainingCopies(); err != nil {
+					log.WithFields(logrus.Fields{
+						"error": err.Error(),
+					}).Warn("Unable to remove expired training copies")
+				}
+			}
+		}()
+	}
+
+	process := func(peer smtpd.Peer, e smtpd.Envelope) error {
 		log.Debug("Started parsing")
 
-		// Check recipients for Lavaboom users
-		recipients := []interface{}{}
+		// Resolve recipients into Lavaboom accounts
+		resolvedRecipients, srsRecipients, err := resolveEnvelope(e)
+		if err != nil {
+			return err
+		}
+
+		accountIDs := []interface{}{}
+		envelopeRecipients := map[string][]string{}
+		recipientTags := map[string][]string{}
+		recipientGroups := map[string][]string{}
+		bounceIDs := map[string][]string{}
 		for _, recipient := range e.Recipients {
 			log.Printf("EMAIL TO %s", recipient)
 
-			// Split the email address into username and domain
-			parts := strings.Split(recipient, "@")
-			if len(parts) != 2 {
-				return describeError(fmt.Errorf("Invalid recipient email address"))
-			}
+			for _, r := range resolvedRecipients[recipient] {
+				if _, ok := envelopeRecipients[r.Account]; !ok {
+					accountIDs = append(accountIDs, r.Account)
+				}
+				envelopeRecipients[r.Account] = append(envelopeRecipients[r.Account], recipient)
 
-			// Check if we support that domain
-			if _, ok := domains[parts[1]]; ok {
-				recipients = append(recipients,
-					utils.RemoveDots(
-						utils.NormalizeUsername(parts[0]),
-					),
-				)
+				if strings.HasPrefix(r.Tag, verpPrefix) {
+					// Tag carries ID of an email that we sent
+					bounceIDs[r.Account] = append(bounceIDs[r.Account], r.Tag[len(verpPrefix):])
+				} else if r.Tag != "" {
+					recipientTags[r.Account] = append(recipientTags[r.Account], r.Tag)
+				}
+				if r.Group != nil {
+					recipientGroups[r.Account] = append(recipientGroups[r.Account], r.Group.Address)
+				}
 			}
 		}
 
 		log.Debug("Parsed recipients")
 
-		// If we didn't find a recipient, return an error
-		if len(recipients) == 0 {
-			return describeError(fmt.Errorf("Not supported email domain"))
-		}
-
-		// Fetch the mapping
-		cursor, err := gorethink.Db(config.RethinkDatabase).Table("addresses").GetAll(recipients...).Run(session)
+		// Retries of the same envelope resume the processing
+		key := processingKey(e.Data, e.Recipients)
+		delivery, err := startDelivery(key)
 		if err != nil {
 			return describeError(err)
 		}
-		defer cursor.Close()
-		var addresses []*models.Address
-		if err := cursor.All(&addresses); err != nil {
-			return describeError(err)
-		}
 
-		// Transform the mapping into accounts
-		accountIDs := []interface{}{}
-		for _, address := range addresses {
-			accountIDs = append(accountIDs, address.Owner)
+		// Route bounces of forwarded emails back to the original senders
+		for _, recipient := range srsRecipients {
+			if delivery.IsForwarded(recipient) {
+				continue
+			}
+
+			if err := relayBounce(e.Data, recipient); err != nil {
+				return describeError(err)
+			}
+
+			if err := recordForward(key, recipient); err != nil {
+				return describeError(err)
+			}
+		}
+		if len(accountIDs) == 0 {
+			return nil
 		}
 
 		// Fetch accounts
-		cursor, err = gorethink.Db(config.RethinkDatabase).Table("accounts").GetAll(accountIDs...).Run(session)
+		accounts, err := getAccounts(accountIDs)
 		if err != nil {
 			return describeError(err)
 		}
-		defer cursor.Close()
-		var accounts []*models.Account
-		if err := cursor.All(&accounts); err != nil {
-			return describeError(err)
-		}
 
 		// Compare request and result lengths
-		if len(accounts) != len(recipients) {
-			return describeError(fmt.Errorf("One of the email addresses wasn't found"))
+		if len(accounts) != len(accountIDs) {
+			return unknownUserError(errors.New("One of the email addresses wasn't found"))
 		}
 
 		log.Debug("Recipients found")
 
-		// Prepare a variable for the combined keyring of recipients
-		toKeyring := []*openpgp.Entity{}
+		pendingAccounts := []*models.Account{}
+		for _, account := range accounts {
+			if !delivery.IsCompleted(account.ID) {
+				pendingAccounts = append(pendingAccounts, account)
+			}
+		}
+		accounts = pendingAccounts
+
+		if len(accounts) == 0 {
+			log.WithFields(logrus.Fields{
+				"key": key,
+			}).Info("Envelope was already processed")
+			return nil
+		}
+
+		// Prepare a map of recipients' keyrings
+		accountKeys := map[string]openpgp.EntityList{}
 
 		// Fetch users' public keys
 		for _, account := range accounts {
-			account.Key, err = getAccountPublicKey(account)
-			if err != nil {
+			keys, err := getAccountKeys(account)
+			if err == errNoUsableKey {
+				return missingKeyError(errors.New("Recipient has no usable encryption key"))
+			} else if err != nil {
 				return describeError(err)
 			}
 
-			toKeyring = append(toKeyring, account.Key)
+			accountKeys[account.ID] = keys
 		}
 
 		log.Debug("Fetched keys")
 
 		// Check in the antispam
-		isSpam := false
-		spamReply, err := spam.Report(string(e.Data))
-		if err == nil {
-			log.Print(spamReply.Code)
-			log.Print(spamReply.Message)
-			log.Print(spamReply.Vars)
+		spamResult, err := spamChecker.Check(e.Data)
+		if err != nil {
+			if !config.SpamFailOpen {
+				return describeError(err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Warn("Accepting an email without a spam check")
+		} else {
+			log.WithFields(logrus.Fields{
+				"score":     spamResult.Score,
+				"threshold": spamResult.Threshold,
+				"symbols":   spamResult.Symbols,
+			}).Debug("Checked the email for spam")
 		}
-		if spamReply.Code == spamc.EX_OK {
-			log.Print("Proper code")
-			if spam, ok := spamReply.Vars["isSpam"]; ok && spam.(bool) {
-				log.Print("It's spam.")
-				isSpam = true
+
+		// Apply accounts' own thresholds
+		spamAccounts := map[string]bool{}
+		if spamResult != nil {
+			for _, account := range accounts {
+				threshold, err := getSpamThreshold(account)
+				if err != nil {
+					return describeError(err)
+				}
+
+				spamAccounts[account.ID] = spamResult.IsSpam(threshold)
 			}
 		}
 
 		// Parse the email
 		email, err := ParseEmail(bytes.NewReader(e.Data))
 		if err != nil {
-			return describeError(err)
+			return contentError(err)
+		}
+
+		// Envelope sender becomes the Return-Path. Null sender is reserved
+		// for delivery status notifications.
+		returnPath := e.Sender
+		email.Headers["Return-Path"] = []string{"<" + returnPath + ">"}
+		dsn := returnPath == "" || isDSN(email)
+
+		// Bounces of our emails only update the original emails
+		if isDSN(email) {
+			remainingAccounts := []*models.Account{}
+			for _, account := range accounts {
+				marked, err := handleDSN(producer, account, email, bounceIDs[account.ID])
+				if err != nil {
+					return describeError(err)
+				}
+
+				if marked {
+					if err := completeDelivery(key, account.ID); err != nil {
+						return describeError(err)
+					}
+
+					log.WithFields(logrus.Fields{
+						"account": account.ID,
+					}).Info("Processed a bounce")
+					continue
+				}
+
+				remainingAccounts = append(remainingAccounts, account)
+			}
+			accounts = remainingAccounts
+
+			if len(accounts) == 0 {
+				return nil
+			}
+		}
+
+		// Run recipients' filters on the plaintext metadata
+		filterResults := map[string]*sieve.Result{}
+		filteredAccounts := []*models.Account{}
+		for _, account := range accounts {
+			result := &sieve.Result{Keep: true}
+
+			filter, err := getActiveFilter(account)
+			if err != nil {
+				return describeError(err)
+			}
+			if filter != nil {
+				script, err := sieve.Parse(filter.Script)
+				if err != nil {
+					log.WithFields(logrus.Fields{
+						"error":  err.Error(),
+						"filter": filter.ID,
+					}).Warn("Unable to parse a filter")
+				} else {
+					result = script.Evaluate(&sieve.Message{
+						Header: email.Headers,
+						From:   returnPath,
+						To:     envelopeRecipients[account.ID],
+						Size:   len(e.Data),
+					})
+				}
+			}
+
+			if result.Discarded() {
+				if err := completeDelivery(key, account.ID); err != nil {
+					return describeError(err)
+				}
+
+				log.WithFields(logrus.Fields{
+					"account": account.ID,
+				}).Info("Email discarded by a filter")
+				continue
+			}
+
+			// Forward the email if the account has a forwarding rule. Spam is
+			// kept, so that we don't send it any further.
+			var forward *Forward
+			if srs != nil && !spamAccounts[account.ID] {
+				forward, err = getForward(account)
+				if err != nil {
+					return describeError(err)
+				}
+			}
+			if forward != nil && len(envelopeRecipients[account.ID]) > 0 {
+				address := strings.ToLower(envelopeRecipients[account.ID][0])
+
+				if isForwardingLoop(email, address) {
+					log.WithFields(logrus.Fields{
+						"account": account.ID,
+					}).Warn("Forwarding loop detected, keeping the email")
+				} else {
+					// Retries don't forward the email again
+					if !delivery.IsForwarded(account.ID) {
+						if err := forwardEmail(e.Data, returnPath, address, forward.Address); err != nil {
+							return describeError(err)
+						}
+
+						if err := recordForward(key, account.ID); err != nil {
+							return describeError(err)
+						}
+					}
+
+					if !forward.KeepCopy {
+						if err := completeDelivery(key, account.ID); err != nil {
+							return describeError(err)
+						}
+
+						continue
+					}
+				}
+			}
+
+			filterResults[account.ID] = result
+			filteredAccounts = append(filteredAccounts, account)
+		}
+		accounts = filteredAccounts
+
+		// Every recipient discarded the email
+		if len(accounts) == 0 {
+			return nil
 		}
 
 		// Determine email's kind
 		contentType := email.Headers.Get("Content-Type")
 		kind := "raw"
-		if strings.HasPrefix(contentType, "multipart/encrypted") {
-			// multipart/encrypted is dedicated for PGP/MIME and S/MIME
+		if isSMIME(contentType) {
+			// application/pkcs7-mime or multipart/encrypted with a PKCS #7 protocol
+			kind = "smime"
+		} else if strings.HasPrefix(contentType, "multipart/encrypted") {
+			// Every other multipart/encrypted email is treated as PGP/MIME
 			kind = "pgpmime"
 		} else if strings.HasPrefix(contentType, "multipart/mixed") && len(email.Children) >= 2 {
 			// Has manifest? It is an email with a PGP manifest. If not, it's unencrypted.
@@ -212,13 +584,37 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 		// Declare variables used later for data insertion
 		var (
-			subject  string
-			manifest string
-			body     string
-			fileIDs  = map[string][]string{}
-			files    = []*models.File{}
+			subject         string
+			manifest        string
+			body            string
+			manifests       = map[string]string{}
+			bodies          = map[string]string{}
+			bodyContentType string
+			signature       *Signature
+			fileIDs         = map[string][]string{}
+			files           = []*models.File{}
 		)
 
+		// Verify signatures of multipart/signed emails before they get flattened
+		if strings.HasPrefix(contentType, "multipart/signed") {
+			signature, err = verifySigned(e.Data, email)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Warn("Unable to verify a signed email")
+			}
+		}
+
+		// Opaque signed emails carry the plaintext inside of the blob, so
+		// they're encrypted as an attachment like any other content
+		if isOpaqueSMIME(contentType) {
+			signature = verifySMIME(email.Body, nil)
+
+			if disposition, _, err := mime.ParseMediaType(email.Headers.Get("Content-Disposition")); err != nil || disposition != "attachment" {
+				email.Headers["Content-Disposition"] = []string{`attachment; filename="smime.p7m"`}
+			}
+		}
+
 		// Transform raw emails into encrypted with manifests
 		if kind == "raw" {
 			// Prepare variables for manifest generation
@@ -303,13 +699,7 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 					if err == nil && disposition == "attachment" {
 						// We're dealing with an attachment
-						id := uniuri.NewLen(uniuri.UUIDLen)
-
-						// Encrypt the body
-						encryptedBody, err := shared.EncryptAndArmor(msg.Body, toKeyring)
-						if err != nil {
-							return describeError(err)
-						}
+						id := processingID(key, "part", strconv.Itoa(len(parts)))
 
 						// Hash the body
 						rawHash := sha256.Sum256(msg.Body)
@@ -325,7 +715,13 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 						})
 
 						for _, account := range accounts {
-							fid := uniuri.NewLen(uniuri.UUIDLen)
+							// Encrypt the body separately for every recipient
+							encryptedBody, err := shared.EncryptAndArmor(msg.Body, accountKeys[account.ID])
+							if err != nil {
+								return describeError(err)
+							}
+
+							fid := processingID(key, account.ID, "file", id)
 
 							files = append(files, &models.File{
 								Resource: models.Resource{
@@ -414,7 +810,11 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 			// Push files into RethinkDB
 			for _, file := range files {
-				if err := gorethink.Db(config.RethinkDatabase).Table("files").Insert(file).Exec(session); err != nil {
+				if err := recordDeliveryFile(key, file.Owner, file.ID); err != nil {
+					return describeError(err)
+				}
+
+				if err := insertCharged("files", file.Owner, file, 0, len(file.Data)); err != nil {
 					return describeError(err)
 				}
 			}
@@ -465,22 +865,30 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 				Parts:   parts,
 			}
 
-			// Encrypt the manifest and the body
-			encryptedBody, err := shared.EncryptAndArmor([]byte(bodyText), toKeyring)
-			if err != nil {
-				return describeError(err)
+			if signature != nil {
+				rawManifest.Headers = signature.Headers()
 			}
+
 			strManifest, err := man.Write(rawManifest)
 			if err != nil {
 				return describeError(err)
 			}
-			encryptedManifest, err := shared.EncryptAndArmor(strManifest, toKeyring)
-			if err != nil {
-				return describeError(err)
+
+			// Encrypt the manifest and the body separately for every recipient
+			for _, account := range accounts {
+				encryptedBody, err := shared.EncryptAndArmor([]byte(bodyText), accountKeys[account.ID])
+				if err != nil {
+					return describeError(err)
+				}
+				encryptedManifest, err := shared.EncryptAndArmor(strManifest, accountKeys[account.ID])
+				if err != nil {
+					return describeError(err)
+				}
+
+				bodies[account.ID] = string(encryptedBody)
+				manifests[account.ID] = string(encryptedManifest)
 			}
 
-			body = string(encryptedBody)
-			manifest = string(encryptedManifest)
 			kind = "manifest"
 
 			_ = subject
@@ -506,7 +914,7 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 			// Check that we found both parts
 			if manifestIndex == -1 || bodyIndex == -1 {
-				return describeError(fmt.Errorf("Invalid PGP/Manifest email"))
+				return contentError(errors.New("Invalid PGP/Manifest email"))
 			}
 
 			// Search for the body child index
@@ -522,7 +930,7 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 			// Check that we found it
 			if bodyChildIndex == -1 {
-				return describeError(fmt.Errorf("Invalid PGP/Manifest email body"))
+				return contentError(errors.New("Invalid PGP/Manifest email body"))
 			}
 
 			// Find the manifest and the body
@@ -542,9 +950,13 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 				}
 
 				for _, account := range accounts {
-					fid := uniuri.NewLen(uniuri.UUIDLen)
+					fid := processingID(key, account.ID, "file", strconv.Itoa(index))
 
-					if err := gorethink.Db(config.RethinkDatabase).Table("files").Insert(&models.File{
+					if err := recordDeliveryFile(key, account.ID, fid); err != nil {
+						return describeError(err)
+					}
+
+					if err := insertCharged("files", account.ID, &models.File{
 						Resource: models.Resource{
 							ID:           fid,
 							DateCreated:  time.Now(),
@@ -556,7 +968,7 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 							Encoding: "application/pgp-encrypted",
 							Data:     string(child.Body),
 						},
-					}).Exec(session); err != nil {
+					}, 0, len(child.Body)); err != nil {
 						return describeError(err)
 					}
 
@@ -567,6 +979,25 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 					fileIDs[account.ID] = append(fileIDs[account.ID], fid)
 				}
 			}
+		} else if kind == "smime" {
+			// The CMS blob is either the email itself or a part of multipart/encrypted
+			blob := email.Body
+			bodyContentType = contentType
+			for _, child := range email.Children {
+				if ct := child.Headers.Get("Content-Type"); isSMIME(ct) {
+					blob = child.Body
+					bodyContentType = ct
+					break
+				}
+			}
+
+			if len(blob) == 0 {
+				return contentError(errors.New("Invalid S/MIME email"))
+			}
+
+			// Store the blob intact
+			body = base64.StdEncoding.EncodeToString(blob)
+			subject = "Encrypted email"
 		} else if kind == "pgpmime" {
 			for _, child := range email.Children {
 				if strings.Index(child.Headers.Get("Content-Type"), "application/pgp-encrypted") != -1 {
@@ -586,6 +1017,11 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 		// Save the email for each recipient
 		for _, account := range accounts {
+			// Update Autocrypt state of the sender
+			if err := updateAutocrypt(account, email); err != nil {
+				return describeError(err)
+			}
+
 			// Get 3 user's labels
 			cursor, err := gorethink.Db(config.RethinkDatabase).Table("labels").GetAllByIndex("nameOwnerBuiltin", []interface{}{
 				"Inbox",
@@ -610,11 +1046,36 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 			}
 
 			var (
-				inbox = labels[0]
-				spam  = labels[1]
-				trash = labels[2]
+				inbox  = labels[0]
+				spam   = labels[1]
+				trash  = labels[2]
+				isSpam = spamAccounts[account.ID]
 			)
 
+			// Resolve labels that the email was filed into and plus-addressing tags
+			filterResult := filterResults[account.ID]
+			filterLabels, err := getFilterLabels(account, filterResult.Labels)
+			if err != nil {
+				return describeError(err)
+			}
+			tagLabels, err := getTagLabels(account, recipientTags[account.ID])
+			if err != nil {
+				return describeError(err)
+			}
+			filedLabels := []string{}
+			for _, id := range append(filterLabels, tagLabels...) {
+				found := false
+				for _, existing := range filedLabels {
+					if existing == id {
+						found = true
+						break
+					}
+				}
+				if !found {
+					filedLabels = append(filedLabels, id)
+				}
+			}
+
 			// Get the subject's hash
 			subjectHash := email.Headers.Get("Subject-Hash")
 			if subjectHash == "" {
@@ -636,8 +1097,8 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 				subjectHash = hex.EncodeToString(hash[:])
 			}
 
-			// Generate the email ID
-			eid := uniuri.NewLen(uniuri.UUIDLen)
+			// Generate the email ID, the same one for retries
+			eid := processingID(key, account.ID, "email")
 
 			// Prepare from, to and cc
 			from := email.Headers.Get("from")
@@ -657,10 +1118,38 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 				cc = nil
 			}
 
-			// Transform headers into map[string]string
-			fh := map[string]string{}
-			for key, values := range email.Headers {
-				fh[key] = strings.Join(values, ", ")
+			// Keep the original headers for abuse reports
+			headerBlock := append([]byte("Return-Path: <"+returnPath+">\r\n"), HeaderBlock(e.Data)...)
+			encryptedHeaders, err := shared.EncryptAndArmor(headerBlock, accountKeys[account.ID])
+			if err != nil {
+				return describeError(err)
+			}
+
+			// Keep the original message for export and DKIM verification
+			encryptedOriginal, err := shared.EncryptAndArmor(e.Data, accountKeys[account.ID])
+			if err != nil {
+				return describeError(err)
+			}
+
+			oid := processingID(key, account.ID, "original")
+			if err := recordDeliveryFile(key, account.ID, oid); err != nil {
+				return describeError(err)
+			}
+
+			if err := insertCharged("files", account.ID, &models.File{
+				Resource: models.Resource{
+					ID:           oid,
+					DateCreated:  time.Now(),
+					DateModified: time.Now(),
+					Name:         "original.eml.pgp",
+					Owner:        account.ID,
+				},
+				Encrypted: models.Encrypted{
+					Encoding: "application/pgp-encrypted",
+					Data:     string(encryptedOriginal),
+				},
+			}, 0, len(encryptedOriginal)); err != nil {
+				return describeError(err)
 			}
 
 			// Find the thread
@@ -749,14 +1238,18 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 					secure = "none"
 				}
 
-				labels := []string{inbox.ID}
+				labels := []string{}
+				if filterResult.Keep {
+					labels = append(labels, inbox.ID)
+				}
+				labels = append(labels, filedLabels...)
 				if isSpam {
 					labels = append(labels, spam.ID)
 				}
 
 				thread = &models.Thread{
 					Resource: models.Resource{
-						ID:           uniuri.NewLen(uniuri.UUIDLen),
+						ID:           processingID(key, account.ID, "thread"),
 						DateCreated:  time.Now(),
 						DateModified: time.Now(),
 						Name:         "Encrypted thread",
@@ -765,50 +1258,74 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 					Emails:      []string{eid},
 					Labels:      labels,
 					Members:     append(append(to, cc...), from),
-					IsRead:      false,
+					IsRead:      filterResult.Read(),
 					SubjectHash: subjectHash,
 					Secure:      secure,
 				}
 
-				if err := gorethink.Db(config.RethinkDatabase).Table("threads").Insert(thread).Exec(session); err != nil {
+				// Label counters follow the inserted thread
+				if err := writeThread(gorethink.Db(config.RethinkDatabase).Table("threads").Insert(thread, gorethink.InsertOpts{
+					Conflict:      "replace",
+					ReturnChanges: true,
+				})); err != nil {
 					return describeError(err)
 				}
 			} else {
-				var desiredID string
+				desiredIDs := []string{}
 				if isSpam {
-					desiredID = spam.ID
-				} else {
-					desiredID = inbox.ID
+					desiredIDs = append(desiredIDs, spam.ID)
+				} else if filterResult.Keep {
+					desiredIDs = append(desiredIDs, inbox.ID)
 				}
+				desiredIDs = append(desiredIDs, filedLabels...)
 
-				foundLabel := false
-				for _, label := range thread.Labels {
-					if label == desiredID {
-						foundLabel = true
+				for _, desiredID := range desiredIDs {
+					foundLabel := false
+					for _, label := range thread.Labels {
+						if label == desiredID {
+							foundLabel = true
+							break
+						}
+					}
+					if !foundLabel {
+						thread.Labels = append(thread.Labels, desiredID)
+					}
+				}
+
+				// Retries could have already added the email
+				foundEmail := false
+				for _, id := range thread.Emails {
+					if id == eid {
+						foundEmail = true
 						break
 					}
 				}
-				if !foundLabel {
-					thread.Labels = append(thread.Labels, desiredID)
+				if !foundEmail {
+					thread.Emails = append(thread.Emails, eid)
 				}
 
-				thread.Emails = append(thread.Emails, eid)
-
 				update := map[string]interface{}{
 					"date_modified": gorethink.Now(),
-					"is_read":       false,
 					"labels":        thread.Labels,
 					"emails":        thread.Emails,
 				}
 
+				// Emails flagged as seen by a filter don't mark the thread as unread
+				if !filterResult.Read() {
+					update["is_read"] = false
+				}
+
 				// update thread.secure depending on email's kind
 				if (initialKind == "raw" && thread.Secure == "all") ||
 					(initialKind == "manifest" && thread.Secure == "none") ||
-					(initialKind == "pgpmime" && thread.Secure == "none") {
+					(initialKind == "pgpmime" && thread.Secure == "none") ||
+					(initialKind == "smime" && thread.Secure == "none") {
 					update["secure"] = "some"
 				}
 
-				if err := gorethink.Db(config.RethinkDatabase).Table("threads").Get(thread.ID).Update(update).Exec(session); err != nil {
+				if err := writeThread(gorethink.Db(config.RethinkDatabase).Table("threads").Get(thread.ID).Update(update, gorethink.UpdateOpts{
+					ReturnChanges: true,
+				})); err != nil {
 					return describeError(err)
 				}
 			}
@@ -852,24 +1369,38 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 			}
 
 			// Prepare a new email
-			es := &models.Email{
-				Resource: models.Resource{
-					ID:           eid,
-					DateCreated:  time.Now(),
-					DateModified: time.Now(),
-					Name:         subject,
-					Owner:        account.ID,
+			es := &Email{
+				Email: models.Email{
+					Resource: models.Resource{
+						ID:           eid,
+						DateCreated:  time.Now(),
+						DateModified: time.Now(),
+						Name:         subject,
+						Owner:        account.ID,
+					},
+					Kind:        kind,
+					From:        from,
+					To:          to,
+					CC:          cc,
+					Body:        body,
+					ContentType: bodyContentType,
+					Thread:      thread.ID,
+					MessageID:   strings.Trim(email.Headers.Get("Message-ID"), "<>"), // todo: create a message id parser
+					Status:      "received",
 				},
-				Kind:      kind,
-				From:      from,
-				To:        to,
-				CC:        cc,
-				Body:      body,
-				Thread:    thread.ID,
-				MessageID: strings.Trim(email.Headers.Get("Message-ID"), "<>"), // todo: create a message id parser
-				Status:    "received",
 			}
 
+			// Keep track of the groups that the email was sent to
+			es.Groups = recipientGroups[account.ID]
+
+			// Keep the spam verdict for the clients
+			es.Spam = spamResult
+
+			es.Headers = string(encryptedHeaders)
+			es.Original = oid
+			es.ReturnPath = returnPath
+			es.DSN = dsn
+
 			if fileIDs != nil {
 				es.Files = fileIDs[account.ID]
 			}
@@ -878,11 +1409,24 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 				es.Manifest = manifest
 			}
 
-			// Insert the email
-			if err := gorethink.Db(config.RethinkDatabase).Table("emails").Insert(es).Exec(session); err != nil {
+			// Raw emails were encrypted separately for every recipient
+			if encryptedBody, ok := bodies[account.ID]; ok {
+				es.Body = encryptedBody
+				es.Manifest = manifests[account.ID]
+			}
+
+			// Insert the email and account for it
+			if err := insertCharged("emails", account.ID, es, len(es.Body)+len(es.Manifest)+len(es.Headers), 0); err != nil {
 				return describeError(err)
 			}
 
+			// Keep a copy that spamd can learn from once the user classifies the email
+			if config.SpamTrainingSecret != "" {
+				if err := storeTrainingCopy(account.ID, eid, e.Data); err != nil {
+					return describeError(err)
+				}
+			}
+
 			// Prepare a notification message
 			notification, err := json.Marshal(map[string]interface{}{
 				"id":    eid,
@@ -911,6 +1455,21 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 				return describeError(err)
 			}
 
+			// Send a vacation reply if the account is away
+			if !isSpam && !dsn && len(envelopeRecipients[account.ID]) > 0 {
+				if err := sendVacationReply(producer, account, email, returnPath, envelopeRecipients[account.ID][0], thread.ID); err != nil {
+					log.WithFields(logrus.Fields{
+						"error":   err.Error(),
+						"account": account.ID,
+					}).Warn("Unable to send a vacation reply")
+				}
+			}
+
+			// Retries won't deliver the email to this account again
+			if err := completeDelivery(key, account.ID); err != nil {
+				return describeError(err)
+			}
+
 			log.WithFields(logrus.Fields{
 				"id": eid,
 			}).Info("Finished processing an email")
@@ -918,53 +1477,84 @@ func PrepareHandler(config *shared.Flags) func(peer smtpd.Peer, env smtpd.Envelo
 
 		return nil
 	}
-}
 
-func getAccountPublicKey(account *models.Account) (*openpgp.Entity, error) {
-	if account.PublicKey != "" {
-		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("keys").Get(account.PublicKey).Run(session)
-		if err != nil {
-			return nil, err
-		}
-		defer cursor.Close()
-
-		var key *models.Key
-		if err := cursor.One(&key); err != nil {
-			return nil, err
+	// Log internal details of failures and reply with proper codes
+	handle := func(peer smtpd.Peer, e smtpd.Envelope) error {
+		err := process(peer, e)
+		if err == nil {
+			return nil
 		}
 
-		keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
-		if err != nil {
-			return nil, err
+		reply := replyError(err)
+		entry := log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"code":   reply.Code,
+			"sender": e.Sender,
+		})
+		if reply.Code >= 500 {
+			entry.Warn("Rejected an email")
+		} else {
+			entry.Error("Unable to process an email")
 		}
 
-		return keyring[0], nil
+		return reply
 	}
 
-	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("keys").GetAllByIndex("owner", account.ID).Run(session)
-	if err != nil {
-		return nil, err
+	// Trace the hop in every accepted email. It's added before spooling, so
+	// that retries process the same data.
+	receive := func(next func(peer smtpd.Peer, e smtpd.Envelope) error) func(peer smtpd.Peer, e smtpd.Envelope) error {
+		return func(peer smtpd.Peer, e smtpd.Envelope) error {
+			e.AddReceivedLine(peer)
+			return next(peer, e)
+		}
 	}
-	defer cursor.Close()
 
-	var keys []*models.Key
-	if err := cursor.All(&keys); err != nil {
-		return nil, err
-	}
+	// Acknowledge emails once they're on the disk and process them later.
+	// Policies are still checked before that, so that rejections aren't
+	// bounced to forged senders.
+	if config.SpoolDirectory != "" {
+		spool := &Spool{
+			Directory: config.SpoolDirectory,
+			Lifetime:  config.SpoolLifetime,
+			Check: func(peer smtpd.Peer, e smtpd.Envelope) error {
+				if _, _, err := resolveEnvelope(e); err != nil {
+					reply := replyError(err)
+					log.WithFields(logrus.Fields{
+						"error":  err.Error(),
+						"code":   reply.Code,
+						"sender": e.Sender,
+					}).Warn("Rejected an email")
+					return reply
+				}
+				return nil
+			},
+			Process: handle,
+			Log:     log,
+		}
+		if err := spool.Start(config.SpoolWorkers); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Fatal("Unable to start the inbound spool")
+		}
 
-	if len(keys) == 0 {
-		return nil, fmt.Errorf("Recipient has no public key")
-	}
+		// Workers publish with the producer, so they're stopped before it
+		clients.Workers = append(clients.Workers, spool)
 
-	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keys[0].Key))
-	if err != nil {
-		return nil, err
+		log.WithFields(logrus.Fields{
+			"addr":  config.BindAddress,
+			"spool": config.SpoolDirectory,
+		}).Info("Listening for incoming traffic")
+
+		return receive(spool.Handle), clients
 	}
 
-	return keyring[0], nil
-}
+	// Last message sent by PrepareHandler
+	log.WithFields(logrus.Fields{
+		"addr": config.BindAddress,
+	}).Info("Listening for incoming traffic")
 
-func describeError(err error) error {
-	_, file, line, _ := runtime.Caller(1)
-	return fmt.Errorf("%s:%d - %s", file, line, err.Error())
+	return receive(handle), clients
 }
+
+// errNoUsableKey is returned if none of the account's keys can be used
+var errNoUsableKey = errors.New("Recipient has no usable public key")
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+)
+
+// instanceID identifies this instance as the owner of locks
+var instanceID = uniuri.NewLen(uniuri.UUIDLen)
+
+// acquireLock takes or extends a lock shared by all instances. Returns false
+// if another instance holds the lock and it hasn't expired yet.
+func acquireLock(name string, duration time.Duration) (bool, error) {
+	result, err := gorethink.Db(cfg.RethinkDatabase).Table("locks").Get(name).Replace(func(row gorethink.Term) interface{} {
+		return gorethink.Branch(
+			row.Eq(nil).Or(row.Field("owner").Eq(instanceID)).Or(row.Field("date_expires").Lt(gorethink.Now())),
+			map[string]interface{}{
+				"id":           name,
+				"owner":        instanceID,
+				"date_expires": gorethink.Now().Add(duration.Seconds()),
+			},
+			row,
+		)
+	}).RunWrite(session)
+	if err != nil {
+		return false, err
+	}
+	if result.Errors > 0 {
+		return false, errors.New(result.FirstError)
+	}
+
+	return result.Inserted+result.Replaced > 0, nil
+}
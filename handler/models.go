@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/lavab/api/models"
+)
+
+// Email is models.Email extended with the metadata recorded by the mailer
+type Email struct {
+	models.Email
+
+	// AutoSubmitted is set on automatically generated emails, such as vacation replies
+	AutoSubmitted string `json:"auto_submitted,omitempty" gorethink:"auto_submitted,omitempty"`
+
+	// Groups lists the group addresses that the email was delivered through
+	Groups []string `json:"groups,omitempty" gorethink:"groups,omitempty"`
+
+	// Spam is spamd's verdict, unset if the email wasn't checked
+	Spam *SpamResult `json:"spam,omitempty" gorethink:"spam,omitempty"`
+
+	// Headers is the original header block encrypted to the recipient
+	Headers string `json:"headers,omitempty" gorethink:"headers,omitempty"`
+
+	// Original is ID of the file holding the complete original message,
+	// encrypted to the recipient
+	Original string `json:"original,omitempty" gorethink:"original,omitempty"`
+
+	// ReturnPath is the envelope sender (MAIL FROM), empty for null senders
+	ReturnPath string `json:"return_path" gorethink:"return_path"`
+
+	// DSN is set on delivery status notifications, including every email
+	// with a null sender
+	DSN bool `json:"dsn,omitempty" gorethink:"dsn,omitempty"`
+}
+
+// Filter is a Sieve script run on emails delivered to its owner. Only one
+// script of an account can be active.
+type Filter struct {
+	models.Resource
+
+	Script string `json:"script" gorethink:"script"`
+	Active bool   `json:"active" gorethink:"active"`
+}
+
+// Vacation is an account's out-of-office auto-responder configuration
+type Vacation struct {
+	models.Resource
+
+	Enabled bool   `json:"enabled" gorethink:"enabled"`
+	Subject string `json:"subject" gorethink:"subject"`
+	Body    string `json:"body" gorethink:"body"`
+
+	// Replies are sent only between these dates, zero values are unbounded
+	StartDate time.Time `json:"start_date" gorethink:"start_date"`
+	EndDate   time.Time `json:"end_date" gorethink:"end_date"`
+
+	// Domains limits replies to senders from these domains if it's not empty
+	Domains []string `json:"domains" gorethink:"domains"`
+
+	// Days is the minimal interval between two replies to the same sender
+	Days int `json:"days" gorethink:"days"`
+}
+
+// VacationReply records when a sender has last been sent a vacation reply
+type VacationReply struct {
+	models.Resource
+
+	Address string    `json:"address" gorethink:"address"`
+	Date    time.Time `json:"date" gorethink:"date"`
+}
+
+// Forward is an account's rule to forward inbound emails to an external address
+type Forward struct {
+	models.Resource
+
+	Enabled  bool   `json:"enabled" gorethink:"enabled"`
+	Address  string `json:"address" gorethink:"address"`
+	KeepCopy bool   `json:"keep_copy" gorethink:"keep_copy"`
+}
+
+// Alias maps an address in one of our domains to its owner's account
+type Alias struct {
+	models.Resource
+
+	Address string `json:"address" gorethink:"address"` // Normalized, with the domain
+}
+
+// CatchAll delivers emails to unknown addresses of a domain to its owner.
+// The ID of a catch-all is the domain.
+type CatchAll struct {
+	models.Resource
+}
+
+// Group is a distribution address that is expanded into its members
+type Group struct {
+	models.Resource
+
+	Address string   `json:"address" gorethink:"address"` // Normalized, with the domain
+	Members []string `json:"members" gorethink:"members"` // Addresses of members, can be other groups
+
+	// MembersOnly rejects emails from senders that aren't members of the group
+	MembersOnly bool `json:"members_only" gorethink:"members_only"`
+}
+
+// Usage is the storage used by an account. Its ID is the account's ID.
+type Usage struct {
+	ID           string    `json:"id" gorethink:"id"`
+	Emails       int64     `json:"emails" gorethink:"emails"` // Bytes used by email bodies, manifests and original headers
+	Files        int64     `json:"files" gorethink:"files"`   // Bytes used by attachments and original messages
+	DateModified time.Time `json:"date_modified" gorethink:"date_modified"`
+}
+
+// Total returns the total number of used bytes
+func (u *Usage) Total() int64 {
+	return u.Emails + u.Files
+}
+
+// Delivery is the progress of processing an envelope. Its ID is the
+// envelope's processing key.
+type Delivery struct {
+	ID           string    `json:"id" gorethink:"id"`
+	DateCreated  time.Time `json:"date_created" gorethink:"date_created"`
+	DateModified time.Time `json:"date_modified" gorethink:"date_modified"`
+
+	// Completed lists the accounts that the envelope was delivered to
+	Completed []string `json:"completed" gorethink:"completed"`
+
+	// Files lists the files inserted while processing the envelope
+	Files []*DeliveryFile `json:"files" gorethink:"files"`
+
+	// Forwarded lists the accounts that forwarded the envelope and the SRS
+	// addresses that it was relayed to
+	Forwarded []string `json:"forwarded" gorethink:"forwarded"`
+}
+
+// DeliveryFile is a file inserted while processing an envelope
+type DeliveryFile struct {
+	ID    string `json:"id" gorethink:"id"`
+	Owner string `json:"owner" gorethink:"owner"`
+}
+
+// IsCompleted tells whether the envelope was delivered to the account
+func (d *Delivery) IsCompleted(owner string) bool {
+	for _, completed := range d.Completed {
+		if completed == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// IsForwarded tells whether the envelope was forwarded by the account or
+// relayed to the SRS address
+func (d *Delivery) IsForwarded(id string) bool {
+	for _, forwarded := range d.Forwarded {
+		if forwarded == id {
+			return true
+		}
+	}
+	return false
+}
+
+// TrainingCopy is an encrypted copy of a received email kept for spam
+// training. Its ID is the ID of the email.
+type TrainingCopy struct {
+	models.Resource
+
+	// Data is the raw email sealed using the training secret
+	Data []byte `json:"data" gorethink:"data"`
+
+	// Class is the class that spamd has last learned the email as
+	Class string `json:"class,omitempty" gorethink:"class,omitempty"`
+}
+
+// SpamSettings is an account's spam filtering configuration
+type SpamSettings struct {
+	models.Resource
+
+	// Threshold overrides spamd's score threshold, unless it's zero
+	Threshold float64 `json:"threshold" gorethink:"threshold"`
+}
@@ -126,3 +126,16 @@ func ParseEmail(input io.Reader) (*Message, error) {
 	// Return the parsed email
 	return message, nil
 }
+
+// HeaderBlock returns the raw header block of an email, without the blank
+// line separating it from the body.
+func HeaderBlock(data []byte) []byte {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		return data[:i+2]
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i != -1 {
+		return data[:i+1]
+	}
+
+	return data
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// verifyPGP checks a detached PGP signature of a multipart/signed email
+func verifyPGP(content []byte, armored []byte, email *Message) (*Signature, error) {
+	signature := &Signature{
+		Type:   "pgp",
+		Status: "invalid",
+	}
+
+	// Read the signature packet to find out its issuer and creation time
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil {
+		return signature, nil
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return signature, nil
+	}
+
+	var issuer uint64
+	switch sig := p.(type) {
+	case *packet.Signature:
+		if sig.IssuerKeyId == nil {
+			return signature, nil
+		}
+		issuer = *sig.IssuerKeyId
+		signature.Date = &sig.CreationTime
+	case *packet.SignatureV3:
+		issuer = sig.IssuerKeyId
+		signature.Date = &sig.CreationTime
+	default:
+		return signature, nil
+	}
+
+	// Keys of our users are trusted if they own the sender's address
+	keyring, err := findSignerKeys(email.Headers.Get("From"), issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(armored))
+	if err == nil {
+		signature.Status = "valid"
+		signature.Signer = entityName(signer)
+		signature.Fingerprint = strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+		return signature, nil
+	} else if err != pgperrors.ErrUnknownIssuer {
+		return signature, nil
+	}
+
+	// Keys sent along with the email only prove that the email wasn't
+	// modified, anyone can attach a key with any name
+	keyring = append(autocryptKeys(email), attachedKeys(email)...)
+	signer, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(armored))
+	if err == pgperrors.ErrUnknownIssuer {
+		signature.Status = "unknown"
+		return signature, nil
+	} else if err != nil {
+		return signature, nil
+	}
+
+	signature.Status = "unverified-key"
+	signature.Fingerprint = strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+	return signature, nil
+}
+
+// findSignerKeys returns keys of the account owning the From address that
+// contain the issuer, either as the primary key or as a subkey
+func findSignerKeys(from string, issuer uint64) (openpgp.EntityList, error) {
+	keyring := openpgp.EntityList{}
+
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return keyring, nil
+	}
+
+	recipients, err := resolveAddress(address.Address, false)
+	if err == errUnsupportedDomain || err == errUnknownRecipient {
+		return keyring, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, recipient := range recipients {
+		// Groups don't sign on behalf of their members
+		if recipient.Group != nil {
+			continue
+		}
+
+		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("keys").GetAllByIndex("owner", recipient.Account).Run(session)
+		if err != nil {
+			return nil, err
+		}
+		var keys []*models.Key
+		err = cursor.All(&keys)
+		cursor.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
+			if err != nil {
+				continue
+			}
+
+			for _, entity := range entities {
+				if len(openpgp.EntityList{entity}.KeysById(issuer)) > 0 {
+					keyring = append(keyring, entity)
+				}
+			}
+		}
+	}
+
+	return keyring, nil
+}
+
+// attachedKeys parses all application/pgp-keys parts of an email
+func attachedKeys(msg *Message) openpgp.EntityList {
+	keyring := openpgp.EntityList{}
+
+	if strings.HasPrefix(msg.Headers.Get("Content-Type"), "application/pgp-keys") {
+		if entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(msg.Body)); err == nil {
+			keyring = append(keyring, entities...)
+		}
+	}
+
+	for _, child := range msg.Children {
+		keyring = append(keyring, attachedKeys(child)...)
+	}
+
+	return keyring
+}
+
+// entityName returns the primary identity of an entity
+func entityName(entity *openpgp.Entity) string {
+	names := []string{}
+	for name, identity := range entity.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+	return names[0]
+}
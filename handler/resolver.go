@@ -0,0 +1,371 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/utils"
+	"github.com/lavab/smtpd"
+
+	"github.com/lavab/mailer/shared"
+)
+
+// Limits of group expansion
+const (
+	maxGroupDepth   = 5
+	maxGroupMembers = 100
+)
+
+var (
+	// errUnsupportedDomain is returned for addresses outside of our domains
+	errUnsupportedDomain = errors.New("Not supported email domain")
+
+	// errUnknownRecipient is returned if an address doesn't map to any account
+	errUnknownRecipient = errors.New("Unknown recipient")
+
+	// errGroupLimit is returned if a group expands too deep or to too many members
+	errGroupLimit = errors.New("Group expansion limit exceeded")
+)
+
+// Recipient is an envelope recipient resolved into an account
+type Recipient struct {
+	Address string   // Address of the account, as passed in RCPT TO or in the group
+	Account string   // ID of the account
+	Tag     string   // Plus-addressing tag, applied if the account has such a label
+	Group   *Group   // Group that the recipient was expanded from
+	Path    []*Group // Groups that the recipient was expanded through, outermost first
+}
+
+// resolveRecipient maps an envelope recipient to accounts. Addresses are
+// looked up directly, then in aliases, groups and at last in the domain's
+// catch-all. Groups are expanded into their members.
+func resolveRecipient(address string) ([]*Recipient, error) {
+	return resolveAddress(address, true)
+}
+
+// resolveAddress resolves the address like resolveRecipient. Lookups that
+// aren't of envelope recipients are left out of the filter's statistics.
+func resolveAddress(address string, recordStats bool) ([]*Recipient, error) {
+	if recipientFilter != nil && !recipientFilter.MayExist(address, recordStats) {
+		return nil, errUnknownRecipient
+	}
+
+	recipients, err := expandRecipient(address, "", nil, map[string]struct{}{}, 0)
+	if err == errUnknownRecipient && recipientFilter != nil && recordStats {
+		recipientFilter.FalsePositive()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Groups without any deliverable members are unknown too
+	if len(recipients) == 0 {
+		return nil, errUnknownRecipient
+	}
+
+	if len(recipients) > maxGroupMembers {
+		return nil, errGroupLimit
+	}
+
+	return recipients, nil
+}
+
+func expandRecipient(address string, tag string, path []*Group, seen map[string]struct{}, depth int) ([]*Recipient, error) {
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid recipient email address")
+	}
+
+	domain := strings.ToLower(parts[1])
+	if _, ok := domains[domain]; !ok {
+		return nil, errUnsupportedDomain
+	}
+
+	// Split off the plus-addressing tag
+	local := parts[0]
+	if i := strings.Index(local, "+"); i != -1 {
+		tag = local[i+1:]
+		local = local[:i]
+	}
+
+	name := utils.RemoveDots(
+		utils.NormalizeUsername(local),
+	)
+
+	// Every address is expanded only once, which also breaks group cycles
+	if _, ok := seen[name+"@"+domain]; ok {
+		return nil, nil
+	}
+	seen[name+"@"+domain] = struct{}{}
+
+	recipient := &Recipient{
+		Address: address,
+		Tag:     tag,
+		Path:    path,
+	}
+
+	// Members are delivered to as members of the outermost group
+	if len(path) > 0 {
+		recipient.Group = path[0]
+	}
+
+	// Account's own address
+	owner, err := getAddressOwner(name)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		recipient.Account = owner
+		return []*Recipient{recipient}, nil
+	}
+
+	// Explicit alias
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("aliases").GetAllByIndex("address", name+"@"+domain).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var aliases []*Alias
+	if err := cursor.All(&aliases); err != nil {
+		return nil, err
+	}
+	if len(aliases) > 0 {
+		recipient.Account = aliases[0].Owner
+		return []*Recipient{recipient}, nil
+	}
+
+	// Group address
+	cursor, err = gorethink.Db(cfg.RethinkDatabase).Table("groups").GetAllByIndex("address", name+"@"+domain).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var groups []*Group
+	if err := cursor.All(&groups); err != nil {
+		return nil, err
+	}
+	if len(groups) > 0 {
+		if depth >= maxGroupDepth {
+			return nil, errGroupLimit
+		}
+
+		// Paths of members can't share the array
+		memberPath := append(append([]*Group{}, path...), groups[0])
+
+		recipients := []*Recipient{}
+		for _, member := range groups[0].Members {
+			expanded, err := expandRecipient(member, tag, memberPath, seen, depth+1)
+			if err == errUnknownRecipient || err == errUnsupportedDomain {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			recipients = append(recipients, expanded...)
+			if len(recipients) > maxGroupMembers {
+				return nil, errGroupLimit
+			}
+		}
+
+		return recipients, nil
+	}
+
+	// Domain's catch-all
+	cursor, err = gorethink.Db(cfg.RethinkDatabase).Table("catch_alls").Get(domain).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var catchAll *CatchAll
+	if err := cursor.One(&catchAll); err != nil && err != gorethink.ErrEmptyResult {
+		return nil, err
+	}
+	if catchAll != nil {
+		recipient.Account = catchAll.Owner
+		return []*Recipient{recipient}, nil
+	}
+
+	return nil, errUnknownRecipient
+}
+
+// isGroupMember checks whether the sender is one of resolved group members
+func isGroupMember(sender string, members []*Recipient) (bool, error) {
+	resolved, err := resolveAddress(sender, false)
+	if err == errUnsupportedDomain || err == errUnknownRecipient {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, account := range resolved {
+		for _, member := range members {
+			if account.Account == member.Account {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// groupMembers returns the recipients expanded through the group
+func groupMembers(recipients []*Recipient, group *Group) []*Recipient {
+	members := []*Recipient{}
+	for _, recipient := range recipients {
+		for _, g := range recipient.Path {
+			if g == group {
+				members = append(members, recipient)
+				break
+			}
+		}
+	}
+
+	return members
+}
+
+// resolveEnvelope resolves the envelope's recipients and applies policies
+// that have to be enforced before the email is accepted, as a rejection
+// after that would bounce it to a possibly forged sender. Returns resolved
+// recipients by the envelope's addresses and the SRS addresses among them.
+func resolveEnvelope(e smtpd.Envelope) (map[string][]*Recipient, []string, error) {
+	var (
+		resolved      = map[string][]*Recipient{}
+		srsRecipients = []string{}
+	)
+
+	for _, recipient := range e.Recipients {
+		// Bounces of forwarded emails are sent to SRS addresses
+		if isSRSRecipient(recipient) {
+			srsRecipients = append(srsRecipients, recipient)
+			continue
+		}
+
+		recipients, err := resolveRecipient(recipient)
+		if err == errUnsupportedDomain {
+			continue
+		} else if err == errUnknownRecipient {
+			return nil, nil, unknownUserError(errors.New("One of the email addresses wasn't found"))
+		} else if err == errGroupLimit {
+			return nil, nil, groupLimitError(err)
+		} else if err != nil {
+			return nil, nil, describeError(err)
+		}
+
+		// Some groups accept emails only from their members, including
+		// groups nested in open ones
+		checked := map[*Group]struct{}{}
+		for _, r := range recipients {
+			for _, group := range r.Path {
+				if _, ok := checked[group]; ok || !group.MembersOnly {
+					continue
+				}
+				checked[group] = struct{}{}
+
+				member, err := isGroupMember(e.Sender, groupMembers(recipients, group))
+				if err != nil {
+					return nil, nil, describeError(err)
+				}
+				if !member {
+					return nil, nil, policyError(errors.New("Only members can post to " + group.Address))
+				}
+			}
+		}
+
+		resolved[recipient] = recipients
+	}
+
+	// If we didn't find a recipient, return an error
+	if len(resolved) == 0 && len(srsRecipients) == 0 {
+		return nil, nil, policyError(errors.New("Relaying denied"))
+	}
+
+	// Anything but bounces would turn SRS addresses into an open relay
+	if len(srsRecipients) > 0 {
+		if e.Sender != "" {
+			return nil, nil, policyError(errors.New("SRS addresses accept only delivery status notifications"))
+		}
+
+		email, err := ParseEmail(bytes.NewReader(e.Data))
+		if err != nil {
+			return nil, nil, contentError(err)
+		}
+		if !isDSN(email) {
+			return nil, nil, policyError(errors.New("SRS addresses accept only delivery status notifications"))
+		}
+	}
+
+	return resolved, srsRecipients, nil
+}
+
+// isLocalAddress checks whether the address is in one of our domains
+func isLocalAddress(address string) bool {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return false
+	}
+
+	_, ok := domains[strings.ToLower(address[at+1:])]
+	return ok
+}
+
+// isSRSRecipient checks whether the address is a valid SRS address in one of
+// our domains. SRS addresses are rejected if forwarding is disabled.
+func isSRSRecipient(address string) bool {
+	if srs == nil || !shared.IsSRS(address) || !isLocalAddress(address) {
+		return false
+	}
+
+	_, err := srs.Reverse(address)
+	return err == nil
+}
+
+// CheckRecipient validates recipients passed in RCPT TO. It has to be used
+// with the handler returned by PrepareHandler.
+func CheckRecipient(peer smtpd.Peer, address string) error {
+	// Bounces of forwarded emails
+	if shared.IsSRS(address) && isLocalAddress(address) {
+		if !isSRSRecipient(address) {
+			return smtpd.Error{
+				Code:    550,
+				Message: "5.1.1 Invalid SRS address",
+			}
+		}
+
+		return nil
+	}
+
+	recipients, err := resolveRecipient(address)
+	switch err {
+	case nil:
+		// Quotas are enforced per recipient, so that a full mailbox doesn't
+		// delay the email for everyone else
+		full, err := isMailboxFull(recipients)
+		if err != nil {
+			break
+		}
+		if full {
+			return replyError(mailboxFullError(errors.New("Mailbox full")))
+		}
+
+		return nil
+	case errUnsupportedDomain:
+		return smtpd.Error{
+			Code:    550,
+			Message: "5.7.1 Relaying denied",
+		}
+	case errUnknownRecipient:
+		return smtpd.Error{
+			Code:    550,
+			Message: "5.1.1 Unknown recipient",
+		}
+	case errGroupLimit:
+		return replyError(groupLimitError(err))
+	}
+
+	return smtpd.Error{
+		Code:    451,
+		Message: "4.3.0 Temporary failure",
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"github.com/dancannon/gorethink"
+)
+
+// setupTables creates tables and indexes that are used only by the mailer.
+// Errors are ignored, as the tables usually already exist.
+func setupTables() {
+	db := gorethink.Db(cfg.RethinkDatabase)
+
+	db.TableCreate("autocrypt_peers").Exec(session)
+	db.Table("autocrypt_peers").IndexCreate("owner").Exec(session)
+	db.Table("autocrypt_peers").IndexCreateFunc("ownerAddress", func(row gorethink.Term) interface{} {
+		return []interface{}{
+			row.Field("owner"),
+			row.Field("address"),
+		}
+	}).Exec(session)
+
+	db.TableCreate("filters").Exec(session)
+	db.Table("filters").IndexCreate("owner").Exec(session)
+
+	db.TableCreate("vacations").Exec(session)
+	db.Table("vacations").IndexCreate("owner").Exec(session)
+
+	db.TableCreate("vacation_replies").Exec(session)
+	db.Table("vacation_replies").IndexCreate("owner").Exec(session)
+	db.Table("vacation_replies").IndexCreateFunc("ownerAddress", func(row gorethink.Term) interface{} {
+		return []interface{}{
+			row.Field("owner"),
+			row.Field("address"),
+		}
+	}).Exec(session)
+
+	db.TableCreate("forwards").Exec(session)
+	db.Table("forwards").IndexCreate("owner").Exec(session)
+
+	db.TableCreate("aliases").Exec(session)
+	db.Table("aliases").IndexCreate("owner").Exec(session)
+	db.Table("aliases").IndexCreate("address").Exec(session)
+
+	db.TableCreate("catch_alls").Exec(session)
+	db.Table("catch_alls").IndexCreate("owner").Exec(session)
+
+	db.TableCreate("groups").Exec(session)
+	db.Table("groups").IndexCreate("owner").Exec(session)
+	db.Table("groups").IndexCreate("address").Exec(session)
+
+	db.TableCreate("usage").Exec(session)
+
+	db.TableCreate("locks").Exec(session)
+
+	db.TableCreate("deliveries").Exec(session)
+
+	db.TableCreate("spam_training").Exec(session)
+
+	db.TableCreate("spam_settings").Exec(session)
+	db.Table("spam_settings").IndexCreate("owner").Exec(session)
+}
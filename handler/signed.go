@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Signature is the result of verifying a signed inbound email
+type Signature struct {
+	Type        string     `json:"type" gorethink:"type"`     // smime or pgp
+	Status      string     `json:"status" gorethink:"status"` // valid, untrusted, unverified-key, invalid or unknown
+	Signer      string     `json:"signer,omitempty" gorethink:"signer,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty" gorethink:"fingerprint,omitempty"`
+	Date        *time.Time `json:"date,omitempty" gorethink:"date,omitempty"`
+}
+
+// Headers transforms the signature into a set of manifest headers
+func (s *Signature) Headers() map[string]interface{} {
+	headers := map[string]interface{}{
+		"signature-type":   s.Type,
+		"signature-status": s.Status,
+	}
+
+	if s.Signer != "" {
+		headers["signature-signer"] = s.Signer
+	}
+
+	if s.Fingerprint != "" {
+		headers["signature-fingerprint"] = s.Fingerprint
+	}
+
+	if s.Date != nil {
+		headers["signature-date"] = s.Date.UTC().Format(time.RFC3339)
+	}
+
+	return headers
+}
+
+// verifySigned checks the signature of a multipart/signed email. Returns nil
+// if the signature protocol is not supported.
+func verifySigned(data []byte, email *Message) (*Signature, error) {
+	_, params, err := mime.ParseMediaType(email.Headers.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(email.Children) != 2 {
+		return nil, errors.New("Invalid multipart/signed email")
+	}
+
+	content, err := signedContent(data, params["boundary"])
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := strings.ToLower(params["protocol"])
+	switch {
+	case strings.Contains(protocol, "pkcs7-signature"):
+		return verifySMIME(email.Children[1].Body, content), nil
+	case protocol == "application/pgp-signature":
+		return verifyPGP(content, email.Children[1].Body, email)
+	}
+
+	return nil, nil
+}
+
+// signedContent extracts the first part of a multipart/signed email exactly
+// as it was transmitted, with line endings canonicalized to CRLF.
+func signedContent(data []byte, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("No boundary passed")
+	}
+
+	// Canonicalize the line endings
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+
+	// Skip the headers
+	index := bytes.Index(data, []byte("\r\n\r\n"))
+	if index == -1 {
+		return nil, errors.New("Email has no body")
+	}
+	body := append([]byte("\r\n"), data[index+4:]...)
+
+	// Find the first delimiter and skip its line
+	delimiter := []byte("\r\n--" + boundary)
+	start := bytes.Index(body, delimiter)
+	if start == -1 {
+		return nil, errors.New("Signed part not found")
+	}
+	start += len(delimiter)
+	eol := bytes.Index(body[start:], []byte("\r\n"))
+	if eol == -1 {
+		return nil, errors.New("Signed part not found")
+	}
+	start += eol + 2
+
+	// The CRLF preceding the next delimiter belongs to the delimiter
+	end := bytes.Index(body[start:], delimiter)
+	if end == -1 {
+		return nil, errors.New("Signature part not found")
+	}
+
+	return body[start : start+end], nil
+}
@@ -0,0 +1,299 @@
+package handler
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"mime"
+	"strings"
+	"time"
+
+	_ "crypto/sha1"
+	_ "crypto/sha512"
+)
+
+// Object identifiers used by PKCS #7 / CMS
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// Roots trusted to issue S/MIME certificates, nil means the system's roots.
+// Loaded from the -smime_roots bundle.
+var smimeRoots *x509.CertPool
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// isSMIME checks whether passed Content-Type describes an S/MIME encrypted
+// entity. Opaque signed entities carry the plaintext, so they don't match.
+func isSMIME(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch mediaType {
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return strings.ToLower(params["smime-type"]) == "enveloped-data"
+	case "multipart/encrypted":
+		return strings.Contains(params["protocol"], "pkcs7")
+	}
+
+	return false
+}
+
+// isOpaqueSMIME checks whether passed Content-Type describes an S/MIME
+// entity with the signed content encapsulated in it
+func isOpaqueSMIME(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return (mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime") &&
+		strings.ToLower(params["smime-type"]) == "signed-data"
+}
+
+// verifySMIME checks a CMS SignedData blob. If content is nil, the
+// encapsulated content of the blob is verified. Signatures made with
+// certificates that don't chain to a trusted root are reported as untrusted
+// and without a signer, as anyone can embed a certificate with any name.
+// Blobs that can't be parsed, eg. BER-encoded ones, are reported as unknown,
+// as only a signature that doesn't match means that the email was altered.
+func verifySMIME(blob []byte, content []byte) *Signature {
+	signature := &Signature{
+		Type:   "smime",
+		Status: "unknown",
+	}
+
+	// Unwrap the ContentInfo
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(blob, &ci); err != nil {
+		return signature
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return signature
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return signature
+	}
+
+	// Use the encapsulated content for opaque signatures
+	if content == nil {
+		var inner []byte
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &inner); err != nil {
+			return signature
+		}
+		content = inner
+	}
+
+	if len(sd.SignerInfos) == 0 {
+		return signature
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil || len(certs) == 0 {
+		return signature
+	}
+
+	// Only the first signer is taken into account
+	si := sd.SignerInfos[0]
+
+	var cert *x509.Certificate
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, si.IssuerAndSerialNumber.IssuerName.FullBytes) &&
+			c.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			cert = c
+			break
+		}
+	}
+	if cert == nil {
+		return signature
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	signature.Fingerprint = hex.EncodeToString(fingerprint[:])
+
+	hash, ok := map[string]crypto.Hash{
+		oidSHA1.String():   crypto.SHA1,
+		oidSHA256.String(): crypto.SHA256,
+		oidSHA384.String(): crypto.SHA384,
+		oidSHA512.String(): crypto.SHA512,
+	}[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return signature
+	}
+
+	algorithm := signatureAlgorithm(cert.PublicKeyAlgorithm, hash)
+	if algorithm == x509.UnknownSignatureAlgorithm {
+		return signature
+	}
+
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	// Without authenticated attributes the signature covers the content
+	signed := content
+	if len(si.AuthenticatedAttributes.Bytes) > 0 {
+		attributes, err := parseAttributes(si.AuthenticatedAttributes.Bytes)
+		if err != nil {
+			return signature
+		}
+
+		var messageDigest []byte
+		if value, ok := attributes[oidMessageDigest.String()]; ok {
+			if _, err := asn1.Unmarshal(value, &messageDigest); err != nil {
+				return signature
+			}
+		}
+		if !bytes.Equal(messageDigest, digest) {
+			signature.Status = "invalid"
+			return signature
+		}
+
+		if value, ok := attributes[oidSigningTime.String()]; ok {
+			var signingTime time.Time
+			if _, err := asn1.Unmarshal(value, &signingTime); err == nil {
+				signature.Date = &signingTime
+			}
+		}
+
+		// Attributes are signed as a SET, not as the implicitly tagged field
+		signed = append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+
+	if err := cert.CheckSignature(algorithm, signed, si.EncryptedDigest); err != nil {
+		signature.Status = "invalid"
+		return signature
+	}
+
+	// The signature matches, but the signer is known only if the certificate
+	// was issued by a trusted authority
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	options := x509.VerifyOptions{
+		Roots:         smimeRoots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	if signature.Date != nil {
+		options.CurrentTime = *signature.Date
+	}
+	if _, err := cert.Verify(options); err != nil {
+		signature.Status = "untrusted"
+		return signature
+	}
+
+	signature.Status = "valid"
+	signature.Signer = certificateName(cert)
+	return signature
+}
+
+// certificateName returns the signer's name and email address
+func certificateName(cert *x509.Certificate) string {
+	name := cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		if name == "" {
+			return cert.EmailAddresses[0]
+		}
+
+		return name + " <" + cert.EmailAddresses[0] + ">"
+	}
+
+	return name
+}
+
+// parseAttributes maps attribute OIDs to their first value
+func parseAttributes(input []byte) (map[string][]byte, error) {
+	attributes := map[string][]byte{}
+
+	for len(input) > 0 {
+		var attr attribute
+		rest, err := asn1.Unmarshal(input, &attr)
+		if err != nil {
+			return nil, err
+		}
+
+		attributes[attr.Type.String()] = attr.Values.Bytes
+		input = rest
+	}
+
+	return attributes, nil
+}
+
+func signatureAlgorithm(key x509.PublicKeyAlgorithm, hash crypto.Hash) x509.SignatureAlgorithm {
+	switch key {
+	case x509.RSA:
+		switch hash {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA
+		case crypto.SHA256:
+			return x509.SHA256WithRSA
+		case crypto.SHA384:
+			return x509.SHA384WithRSA
+		case crypto.SHA512:
+			return x509.SHA512WithRSA
+		}
+	case x509.ECDSA:
+		switch hash {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512
+		}
+	}
+
+	return x509.UnknownSignatureAlgorithm
+}
@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type testSigner struct {
+	roots *x509.CertPool
+	certs []*x509.Certificate
+	key   *ecdsa.PrivateKey
+}
+
+// newTestSigner creates a CA and a certificate issued by it for S/MIME
+func newTestSigner(t *testing.T) *testSigner {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	return &testSigner{
+		roots: roots,
+		certs: []*x509.Certificate{leaf},
+		key:   key,
+	}
+}
+
+func mustMarshal(t *testing.T, value interface{}) []byte {
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func wrapASN1(t *testing.T, class int, tag int, data []byte) []byte {
+	return mustMarshal(t, asn1.RawValue{
+		Class:      class,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      data,
+	})
+}
+
+// sign creates a CMS SignedData blob with authenticated attributes. The
+// content is encapsulated unless the signature is detached.
+func (s *testSigner) sign(t *testing.T, content []byte, detached bool) []byte {
+	digest := sha256.Sum256(content)
+
+	attributes := []byte{}
+	for _, attr := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidMessageDigest, digest[:]},
+		{oidSigningTime, time.Now().UTC().Truncate(time.Second)},
+	} {
+		attributes = append(attributes, mustMarshal(t, attribute{
+			Type: attr.oid,
+			Values: asn1.RawValue{
+				FullBytes: wrapASN1(t, asn1.ClassUniversal, asn1.TagSet, mustMarshal(t, attr.value)),
+			},
+		})...)
+	}
+	authenticated := wrapASN1(t, asn1.ClassContextSpecific, 0, attributes)
+
+	// Attributes are signed as a SET
+	signed := sha256.Sum256(append([]byte{0x31}, authenticated[1:]...))
+	encryptedDigest, err := s.key.Sign(rand.Reader, signed[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := s.certs[0]
+	encapsulated := contentInfo{
+		ContentType: oidData,
+	}
+	if !detached {
+		encapsulated.Content = asn1.RawValue{
+			FullBytes: wrapASN1(t, asn1.ClassContextSpecific, 0, mustMarshal(t, content)),
+		}
+	}
+
+	certificates := []byte{}
+	for _, cert := range s.certs {
+		certificates = append(certificates, cert.Raw...)
+	}
+
+	sd := signedData{
+		Version: 1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{
+			{Algorithm: oidSHA256},
+		},
+		ContentInfo: encapsulated,
+		Certificates: asn1.RawValue{
+			FullBytes: wrapASN1(t, asn1.ClassContextSpecific, 0, certificates),
+		},
+		SignerInfos: []signerInfo{
+			{
+				Version: 1,
+				IssuerAndSerialNumber: issuerAndSerial{
+					IssuerName:   asn1.RawValue{FullBytes: leaf.RawIssuer},
+					SerialNumber: leaf.SerialNumber,
+				},
+				DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+				AuthenticatedAttributes:   asn1.RawValue{FullBytes: authenticated},
+				DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+				EncryptedDigest:           encryptedDigest,
+			},
+		},
+	}
+
+	return mustMarshal(t, contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			FullBytes: wrapASN1(t, asn1.ClassContextSpecific, 0, mustMarshal(t, sd)),
+		},
+	})
+}
+
+func withSMIMERoots(roots *x509.CertPool, fn func()) {
+	previous := smimeRoots
+	smimeRoots = roots
+	defer func() {
+		smimeRoots = previous
+	}()
+
+	fn()
+}
+
+func TestVerifySMIMEDetached(t *testing.T) {
+	signer := newTestSigner(t)
+	content := []byte("Content-Type: text/plain\r\n\r\nHello\r\n")
+	blob := signer.sign(t, content, true)
+
+	withSMIMERoots(signer.roots, func() {
+		signature := verifySMIME(blob, content)
+		if signature.Status != "valid" {
+			t.Fatalf("Expected a valid signature, got %s", signature.Status)
+		}
+		if signature.Signer != "Alice <alice@example.com>" {
+			t.Errorf("Unexpected signer %q", signature.Signer)
+		}
+		if signature.Fingerprint == "" || signature.Date == nil {
+			t.Errorf("Signature is missing the fingerprint or date: %+v", signature)
+		}
+	})
+}
+
+func TestVerifySMIMEOpaque(t *testing.T) {
+	signer := newTestSigner(t)
+	blob := signer.sign(t, []byte("Content-Type: text/plain\r\n\r\nHello\r\n"), false)
+
+	withSMIMERoots(signer.roots, func() {
+		if signature := verifySMIME(blob, nil); signature.Status != "valid" {
+			t.Errorf("Expected a valid signature, got %s", signature.Status)
+		}
+	})
+}
+
+func TestVerifySMIMETampered(t *testing.T) {
+	signer := newTestSigner(t)
+	blob := signer.sign(t, []byte("Content-Type: text/plain\r\n\r\nHello\r\n"), true)
+
+	withSMIMERoots(signer.roots, func() {
+		signature := verifySMIME(blob, []byte("Content-Type: text/plain\r\n\r\nGoodbye\r\n"))
+		if signature.Status != "invalid" {
+			t.Errorf("Expected an invalid signature, got %s", signature.Status)
+		}
+		if signature.Signer != "" {
+			t.Errorf("Invalid signature has a signer %q", signature.Signer)
+		}
+	})
+}
+
+func TestVerifySMIMEUntrusted(t *testing.T) {
+	signer := newTestSigner(t)
+	content := []byte("Content-Type: text/plain\r\n\r\nHello\r\n")
+	blob := signer.sign(t, content, true)
+
+	// The certificate chains to a different CA
+	withSMIMERoots(newTestSigner(t).roots, func() {
+		signature := verifySMIME(blob, content)
+		if signature.Status != "untrusted" {
+			t.Errorf("Expected an untrusted signature, got %s", signature.Status)
+		}
+		if signature.Signer != "" {
+			t.Errorf("Untrusted signature has a signer %q", signature.Signer)
+		}
+	})
+}
+
+func TestVerifySMIMEUnparseable(t *testing.T) {
+	for name, blob := range map[string][]byte{
+		"garbage": []byte("not a signature"),
+		// BER with indefinite lengths isn't supported by encoding/asn1
+		"indefinite length": {0x30, 0x80, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x02, 0x00, 0x00},
+	} {
+		if signature := verifySMIME(blob, []byte("content")); signature.Status != "unknown" {
+			t.Errorf("%s: Expected an unknown signature, got %s", name, signature.Status)
+		}
+	}
+}
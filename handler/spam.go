@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+	"github.com/lavab/go-spamc"
+)
+
+const (
+	// Number of consecutive failures that opens the circuit breaker
+	spamBreakerFailures = 5
+
+	// Time for which spamd isn't queried after the breaker opens
+	spamBreakerCooldown = 30 * time.Second
+)
+
+var (
+	// errSpamUnavailable is returned while the circuit breaker is open
+	errSpamUnavailable = errors.New("Spam checks are temporarily unavailable")
+
+	// errSpamTimeout is returned if spamd didn't reply before the deadline
+	errSpamTimeout = errors.New("Spam check timed out")
+)
+
+// SpamResult is spamd's verdict on an email, stored on received emails
+type SpamResult struct {
+	Score     float64  `json:"score" gorethink:"score"`
+	Threshold float64  `json:"threshold" gorethink:"threshold"`
+	Symbols   []string `json:"symbols" gorethink:"symbols"`
+}
+
+// IsSpam compares the score to the threshold. Zero threshold means that
+// spamd's own one is used.
+func (r *SpamResult) IsSpam(threshold float64) bool {
+	if threshold == 0 {
+		threshold = r.Threshold
+	}
+
+	return r.Score >= threshold
+}
+
+// SpamChecker queries spamd with a deadline. Consecutive failures open a
+// circuit breaker, which skips spamd until the cooldown passes. After that
+// a single probe decides whether the breaker closes or opens again.
+type SpamChecker struct {
+	Client  *spamc.Client
+	Timeout time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+	probing   bool
+}
+
+// Check returns spamd's verdict on the email
+func (c *SpamChecker) Check(data []byte) (*SpamResult, error) {
+	c.lock.Lock()
+	probe := false
+	if c.open {
+		if c.probing || time.Now().Before(c.openUntil) {
+			c.lock.Unlock()
+			return nil, errSpamUnavailable
+		}
+		c.probing = true
+		probe = true
+	}
+	c.lock.Unlock()
+
+	type reply struct {
+		out *spamc.SpamDOut
+		err error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		out, err := c.Client.Report(string(data))
+		replies <- reply{out, err}
+	}()
+
+	var (
+		out *spamc.SpamDOut
+		err error
+	)
+	select {
+	case r := <-replies:
+		out, err = r.out, r.err
+		if err == nil && (out == nil || out.Code != spamc.EX_OK) {
+			err = errors.New("Invalid spamd reply")
+		}
+	case <-time.After(c.Timeout):
+		err = errSpamTimeout
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if probe {
+		c.probing = false
+	}
+
+	if err != nil {
+		c.failures++
+		if probe || c.failures >= spamBreakerFailures {
+			c.open = true
+			c.openUntil = time.Now().Add(spamBreakerCooldown)
+			c.failures = 0
+		}
+		return nil, err
+	}
+	c.failures = 0
+	if probe {
+		c.open = false
+	}
+
+	result := &SpamResult{
+		Symbols: []string{},
+	}
+	if score, ok := out.Vars["spamScore"].(float64); ok {
+		result.Score = score
+	}
+	if threshold, ok := out.Vars["baseSpamScore"].(float64); ok {
+		result.Threshold = threshold
+	}
+	if report, ok := out.Vars["report"].([]map[string]interface{}); ok {
+		for _, rule := range report {
+			if symbol, ok := rule["symbol"].(string); ok {
+				result.Symbols = append(result.Symbols, symbol)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// getSpamThreshold returns the account's spam score threshold or zero if
+// the account uses the default one.
+func getSpamThreshold(account *models.Account) (float64, error) {
+	var threshold float64
+	if err := lookupCache.Get(cachePrefix+"spam:"+account.ID, &threshold); err == nil {
+		return threshold, nil
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("spam_settings").GetAllByIndex("owner", account.ID).Run(session)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var settings []*SpamSettings
+	if err := cursor.All(&settings); err != nil {
+		return 0, err
+	}
+
+	if len(settings) > 0 {
+		threshold = settings[0].Threshold
+	}
+
+	lookupCache.Set(cachePrefix+"spam:"+account.ID, threshold, cfg.CacheExpiry)
+	return threshold, nil
+}
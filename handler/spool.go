@@ -0,0 +1,436 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/smtpd"
+)
+
+const (
+	// Delay before the first retry of a spooled envelope, doubled with each attempt
+	spoolMinBackoff = time.Minute
+
+	// Maximal delay between retries of a spooled envelope
+	spoolMaxBackoff = time.Hour
+
+	// Extension of spool entries, temporary files use a different one
+	spoolExtension = ".json"
+)
+
+// Matches enhanced status codes at the beginning of SMTP error messages
+var statusCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}`)
+
+// SpoolEntry is an envelope accepted into the spool and its retry state
+type SpoolEntry struct {
+	ID          string         `json:"id"`
+	Peer        SpoolPeer      `json:"peer"`
+	Envelope    smtpd.Envelope `json:"envelope"`
+	DateCreated time.Time      `json:"date_created"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"next_attempt"`
+	LastError   string         `json:"last_error,omitempty"`
+}
+
+// SpoolPeer is the serializable part of smtpd.Peer
+type SpoolPeer struct {
+	HeloName   string         `json:"helo_name"`
+	Username   string         `json:"username,omitempty"`
+	Protocol   smtpd.Protocol `json:"protocol"`
+	ServerName string         `json:"server_name"`
+	Addr       string         `json:"addr"`
+}
+
+// spoolAddr restores the peer's address as a net.Addr
+type spoolAddr string
+
+func (a spoolAddr) Network() string { return "tcp" }
+func (a spoolAddr) String() string  { return string(a) }
+
+// Spool durably stores accepted envelopes on disk and processes them in
+// the background, retrying failures with an exponential backoff.
+type Spool struct {
+	Directory string
+	Lifetime  time.Duration
+	Check     func(peer smtpd.Peer, e smtpd.Envelope) error // Run before the envelope is accepted
+	Process   func(peer smtpd.Peer, e smtpd.Envelope) error
+	Log       *logrus.Logger
+
+	queue    chan string
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+// Start recovers entries left in the spool directory and starts the workers
+func (s *Spool) Start(workers int) error {
+	if err := os.MkdirAll(s.Directory, 0700); err != nil {
+		return err
+	}
+
+	s.queue = make(chan string)
+	s.stop = make(chan struct{})
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+
+	files, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(s.Directory, file.Name())
+
+		// Temporary files are leftovers of envelopes that weren't acknowledged
+		if filepath.Ext(file.Name()) != spoolExtension {
+			os.Remove(path)
+			continue
+		}
+
+		entry, err := s.read(strings.TrimSuffix(file.Name(), spoolExtension))
+		if err != nil {
+			s.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"file":  path,
+			}).Error("Unable to read a spool entry")
+			continue
+		}
+
+		s.schedule(entry)
+	}
+
+	return nil
+}
+
+// Handle spools the envelope. It's meant to be used as smtpd's handler, so
+// the email is acknowledged only after it has been synced to the disk.
+func (s *Spool) Handle(peer smtpd.Peer, e smtpd.Envelope) error {
+	if s.Check != nil {
+		if err := s.Check(peer, e); err != nil {
+			return err
+		}
+	}
+
+	entry := &SpoolEntry{
+		ID: uniuri.NewLen(uniuri.UUIDLen),
+		Peer: SpoolPeer{
+			HeloName:   peer.HeloName,
+			Username:   peer.Username,
+			Protocol:   peer.Protocol,
+			ServerName: peer.ServerName,
+		},
+		Envelope:    e,
+		DateCreated: time.Now(),
+		NextAttempt: time.Now(),
+	}
+	if peer.Addr != nil {
+		entry.Peer.Addr = peer.Addr.String()
+	}
+
+	if err := s.write(entry); err != nil {
+		s.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to spool an email")
+
+		return smtpd.Error{
+			Code:    451,
+			Message: "4.3.0 Temporary failure",
+		}
+	}
+
+	s.schedule(entry)
+	return nil
+}
+
+// Stop waits for the workers to finish their attempts and stops them.
+// Entries that are waiting for an attempt stay in the spool and are
+// recovered by the next Start.
+func (s *Spool) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.workers.Wait()
+}
+
+// schedule queues the entry for its next attempt
+func (s *Spool) schedule(entry *SpoolEntry) {
+	id := entry.ID
+	time.AfterFunc(entry.NextAttempt.Sub(time.Now()), func() {
+		select {
+		case s.queue <- id:
+		case <-s.stop:
+		}
+	})
+}
+
+func (s *Spool) work() {
+	defer s.workers.Done()
+
+	for {
+		var id string
+		select {
+		case id = <-s.queue:
+		case <-s.stop:
+			return
+		}
+
+		entry, err := s.read(id)
+		if err != nil {
+			s.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    id,
+			}).Error("Unable to read a spool entry")
+			continue
+		}
+
+		s.attempt(entry)
+	}
+}
+
+// attempt processes the entry once and either removes it from the spool,
+// bounces it or schedules a retry.
+func (s *Spool) attempt(entry *SpoolEntry) {
+	peer := smtpd.Peer{
+		HeloName:   entry.Peer.HeloName,
+		Username:   entry.Peer.Username,
+		Protocol:   entry.Peer.Protocol,
+		ServerName: entry.Peer.ServerName,
+		Addr:       spoolAddr(entry.Peer.Addr),
+	}
+
+	err := s.Process(peer, entry.Envelope)
+	if err == nil {
+		if err := s.remove(entry.ID); err != nil {
+			s.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    entry.ID,
+			}).Error("Unable to remove a spool entry")
+		}
+		return
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+
+	// Permanent failures and entries that failed for too long are bounced.
+	// Policies are enforced by Check before the email is accepted, so only
+	// senders that passed them get bounces.
+	permanent := false
+	if serr, ok := err.(smtpd.Error); ok && serr.Code >= 500 {
+		permanent = true
+	}
+	if permanent || time.Since(entry.DateCreated) > s.Lifetime {
+		s.Log.WithFields(logrus.Fields{
+			"error":    entry.LastError,
+			"id":       entry.ID,
+			"attempts": entry.Attempts,
+		}).Warn("Giving up on a spooled email")
+
+		if err := s.bounce(entry, err); err != nil {
+			s.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    entry.ID,
+			}).Error("Unable to send a delivery status notification")
+		}
+
+		if err := s.remove(entry.ID); err != nil {
+			s.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    entry.ID,
+			}).Error("Unable to remove a spool entry")
+		}
+		return
+	}
+
+	backoff := spoolMinBackoff << uint(entry.Attempts-1)
+	if backoff > spoolMaxBackoff || backoff <= 0 {
+		backoff = spoolMaxBackoff
+	}
+	entry.NextAttempt = time.Now().Add(backoff)
+
+	s.Log.WithFields(logrus.Fields{
+		"error":    entry.LastError,
+		"id":       entry.ID,
+		"attempts": entry.Attempts,
+		"retry_in": backoff.String(),
+	}).Warn("Spooled email processing failed")
+
+	// Retry even if the state couldn't be saved, it's lost only on a restart
+	if err := s.write(entry); err != nil {
+		s.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    entry.ID,
+		}).Error("Unable to update a spool entry")
+	}
+
+	s.schedule(entry)
+}
+
+// bounce sends a delivery status notification (RFC 3464) to the envelope's
+// sender. Emails with a null sender are never bounced.
+func (s *Spool) bounce(entry *SpoolEntry, cause error) error {
+	if entry.Envelope.Sender == "" {
+		return nil
+	}
+
+	status := "4.4.7"
+	diagnostic := cause.Error()
+	if serr, ok := cause.(smtpd.Error); ok {
+		if code := statusCodePattern.FindString(serr.Message); code != "" {
+			status = code
+		}
+		diagnostic = fmt.Sprintf("%d %s", serr.Code, serr.Message)
+	}
+
+	// Diagnostics of internal errors contain source paths
+	if !strings.HasPrefix(status, "5.") {
+		diagnostic = "Delivery time expired"
+	}
+
+	var (
+		buffer = &bytes.Buffer{}
+		writer = multipart.NewWriter(buffer)
+	)
+
+	header := "From: Mail Delivery System <MAILER-DAEMON@" + cfg.Hostname + ">\r\n" +
+		"To: " + entry.Envelope.Sender + "\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + uniuri.NewLen(uniuri.UUIDLen) + "@" + cfg.Hostname + ">\r\n" +
+		"Auto-Submitted: auto-replied\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + writer.Boundary() + "\"\r\n" +
+		"\r\n"
+
+	text, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(text, "Your email could not be delivered to the following recipients:\r\n\r\n")
+	for _, recipient := range entry.Envelope.Recipients {
+		fmt.Fprintf(text, "    %s\r\n", recipient)
+	}
+	fmt.Fprintf(text, "\r\nReason: %s\r\n", diagnostic)
+
+	report, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"message/delivery-status"},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(report, "Reporting-MTA: dns; %s\r\n", cfg.Hostname)
+	fmt.Fprintf(report, "Arrival-Date: %s\r\n", entry.DateCreated.Format(time.RFC1123Z))
+	for _, recipient := range entry.Envelope.Recipients {
+		fmt.Fprintf(report, "\r\nFinal-Recipient: rfc822; %s\r\n", recipient)
+		fmt.Fprintf(report, "Action: failed\r\n")
+		fmt.Fprintf(report, "Status: %s\r\n", status)
+		fmt.Fprintf(report, "Diagnostic-Code: smtp; %s\r\n", diagnostic)
+	}
+
+	headers, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"text/rfc822-headers"},
+	})
+	if err != nil {
+		return err
+	}
+	headers.Write(HeaderBlock(entry.Envelope.Data))
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return smtp.SendMail(cfg.SMTPAddress, nil, "", []string{entry.Envelope.Sender}, append([]byte(header), buffer.Bytes()...))
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.Directory, id+spoolExtension)
+}
+
+func (s *Spool) read(id string) (*SpoolEntry, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry *SpoolEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// write atomically replaces the entry's file. The data is synced before the
+// rename and the directory after it, so that an acknowledged envelope
+// survives a crash.
+func (s *Spool) write(entry *SpoolEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	temp := filepath.Join(s.Directory, entry.ID+".tmp")
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if err := os.Rename(temp, s.path(entry.ID)); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return s.syncDirectory()
+}
+
+func (s *Spool) remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.syncDirectory()
+}
+
+func (s *Spool) syncDirectory() error {
+	dir, err := os.Open(s.Directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
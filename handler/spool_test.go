@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lavab/smtpd"
+)
+
+func TestSpoolStopWaitsForAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	spool := &Spool{
+		Directory: dir,
+		Lifetime:  time.Hour,
+		Process: func(peer smtpd.Peer, e smtpd.Envelope) error {
+			close(started)
+			<-release
+			return nil
+		},
+		Log: logrus.New(),
+	}
+	if err := spool.Start(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.Handle(smtpd.Peer{}, smtpd.Envelope{
+		Sender:     "a@example.com",
+		Recipients: []string{"b@example.com"},
+		Data:       []byte("Subject: Test\r\n\r\nTest\r\n"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		spool.Stop()
+		close(stopped)
+	}()
+
+	// The attempt is blocked, so Stop can't return yet
+	select {
+	case <-stopped:
+		t.Fatal("Spool stopped during an attempt")
+	default:
+	}
+
+	close(release)
+	<-stopped
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Processed entry is still spooled in %d files", len(files))
+	}
+
+	// Entries accepted after Stop stay in the spool for the next Start
+	if err := spool.Handle(smtpd.Peer{}, smtpd.Envelope{
+		Sender:     "a@example.com",
+		Recipients: []string{"b@example.com"},
+		Data:       []byte("Subject: Test\r\n\r\nTest\r\n"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err = ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected 1 spooled entry, got %d files", len(files))
+	}
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+	"github.com/lavab/go-spamc"
+)
+
+// Classes of spam training requests
+const (
+	trainingSpam = "spam"
+	trainingHam  = "ham"
+)
+
+// TrainingRequest is published on the spam_marked and ham_marked topics when
+// a user moves a thread to or from Spam. Either the thread or the emails
+// have to be set.
+type TrainingRequest struct {
+	Owner  string   `json:"owner"`
+	Thread string   `json:"thread,omitempty"`
+	Emails []string `json:"emails,omitempty"`
+}
+
+// storeTrainingCopy keeps a copy of the received email, encrypted using the
+// training secret, so that spamd can learn from it once the user classifies
+// the email.
+func storeTrainingCopy(owner string, id string, data []byte) error {
+	sealed, err := sealTrainingData(data)
+	if err != nil {
+		return err
+	}
+
+	training := &TrainingCopy{
+		Resource: models.MakeResource(owner, "Training copy"),
+		Data:     sealed,
+	}
+	training.ID = id
+
+	return gorethink.Db(cfg.RethinkDatabase).Table("spam_training").Insert(training, gorethink.InsertOpts{
+		Conflict: "replace",
+	}).Exec(session)
+}
+
+// trainSpam teaches spamd the class of emails passed in the request. Emails
+// without a training copy, such as expired ones, are skipped.
+func trainSpam(spam *spamc.Client, class string, request *TrainingRequest) (int, error) {
+	ids := request.Emails
+	if request.Thread != "" {
+		cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("threads").Get(request.Thread).Run(session)
+		if err != nil {
+			return 0, err
+		}
+		defer cursor.Close()
+		var thread *models.Thread
+		if err := cursor.One(&thread); err != nil && err != gorethink.ErrEmptyResult {
+			return 0, err
+		}
+
+		if thread != nil && thread.Owner == request.Owner {
+			ids = append(ids, thread.Emails...)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("spam_training").GetAll(args...).Run(session)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var copies []*TrainingCopy
+	if err := cursor.All(&copies); err != nil {
+		return 0, err
+	}
+
+	learnType := spamc.LEARN_HAM
+	if class == trainingSpam {
+		learnType = spamc.LEARN_SPAM
+	}
+
+	trained := 0
+	for _, training := range copies {
+		// Users can only train on their own emails, and only once per class
+		if training.Owner != request.Owner || training.Class == class {
+			continue
+		}
+
+		data, err := openTrainingData(training.Data)
+		if err != nil {
+			return trained, err
+		}
+
+		if _, err := spam.Learn(learnType, string(data)); err != nil {
+			return trained, err
+		}
+
+		if err := gorethink.Db(cfg.RethinkDatabase).Table("spam_training").Get(training.ID).Update(map[string]interface{}{
+			"class":         class,
+			"date_modified": gorethink.Now(),
+		}).Exec(session); err != nil {
+			return trained, err
+		}
+
+		trained++
+	}
+
+	return trained, nil
+}
+
+// parseTrainingRequest decodes a training request from an NSQ message
+func parseTrainingRequest(body []byte) (*TrainingRequest, error) {
+	var request *TrainingRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	if request == nil || request.Owner == "" {
+		return nil, errors.New("Invalid training request")
+	}
+
+	return request, nil
+}
+
+// collectTrainingCopies removes training copies past the retention period
+func collectTrainingCopies() error {
+	return gorethink.Db(cfg.RethinkDatabase).Table("spam_training").Filter(func(row gorethink.Term) gorethink.Term {
+		return row.Field("date_created").Lt(gorethink.Now().Sub(cfg.SpamTrainingRetention.Seconds()))
+	}).Delete().Exec(session)
+}
+
+// sealTrainingData encrypts data using AES-GCM with a key derived from the
+// training secret. The nonce is prepended to the ciphertext.
+func sealTrainingData(data []byte) ([]byte, error) {
+	aead, err := trainingCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// openTrainingData decrypts data encrypted by sealTrainingData
+func openTrainingData(sealed []byte) ([]byte, error) {
+	aead, err := trainingCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Invalid training copy")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func trainingCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(cfg.SpamTrainingSecret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+
+	"github.com/lavab/mailer/shared"
+)
+
+// getUsage returns the storage used by an account
+func getUsage(account *models.Account) (*Usage, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("usage").Get(account.ID).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var usage *Usage
+	if err := cursor.One(&usage); err != nil && err != gorethink.ErrEmptyResult {
+		return nil, err
+	}
+
+	if usage == nil {
+		usage = &Usage{
+			ID: account.ID,
+		}
+	}
+
+	return usage, nil
+}
+
+// addUsage atomically increases the account's usage by sizes of inserted
+// emails and files. Negative sizes give back storage of removed ones.
+func addUsage(owner string, emails int, files int) error {
+	return gorethink.Db(cfg.RethinkDatabase).Table("usage").Get(owner).Replace(func(row gorethink.Term) interface{} {
+		return gorethink.Branch(
+			row.Eq(nil),
+			map[string]interface{}{
+				"id":            owner,
+				"emails":        emails,
+				"files":         files,
+				"date_modified": gorethink.Now(),
+			},
+			row.Merge(map[string]interface{}{
+				"emails":        row.Field("emails").Add(emails),
+				"files":         row.Field("files").Add(files),
+				"date_modified": gorethink.Now(),
+			}),
+		)
+	}).Exec(session)
+}
+
+// insertCharged inserts or replaces a document of the owner and increases
+// the owner's usage only if the document is new, so that retries of an
+// envelope aren't charged again.
+func insertCharged(table string, owner string, document interface{}, emails int, files int) error {
+	result, err := gorethink.Db(cfg.RethinkDatabase).Table(table).Insert(document, gorethink.InsertOpts{
+		Conflict: "replace",
+	}).RunWrite(session)
+	if err != nil {
+		return err
+	}
+	if result.Errors > 0 {
+		return errors.New(result.FirstError)
+	}
+
+	if result.Inserted == 0 {
+		return nil
+	}
+
+	return addUsage(owner, emails, files)
+}
+
+// isMailboxFull checks whether any of the recipients' accounts has used up
+// its quota
+func isMailboxFull(recipients []*Recipient) (bool, error) {
+	ids := []interface{}{}
+	for _, recipient := range recipients {
+		ids = append(ids, recipient.Account)
+	}
+
+	accounts, err := getAccounts(ids)
+	if err != nil {
+		return false, err
+	}
+
+	for _, account := range accounts {
+		quota := shared.Quota(account)
+		if quota == 0 {
+			continue
+		}
+
+		usage, err := getUsage(account)
+		if err != nil {
+			return false, err
+		}
+
+		if usage.Total() >= quota {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// reconcileUsage recomputes usage of every account from stored emails and
+// files, fixing drift caused by deletions and failed updates. Only a single
+// instance reconciles at a time.
+func reconcileUsage() error {
+	// The lock outlives the interval, so that its holder keeps it
+	locked, err := acquireLock("usage_reconcile", 2*cfg.UsageReconcileInterval)
+	if err != nil || !locked {
+		return err
+	}
+
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("accounts").Pluck("id").Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var accounts []*models.Account
+	if err := cursor.All(&accounts); err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		usage, err := getUsage(account)
+		if err != nil {
+			return err
+		}
+
+		emails, err := sumSizes("emails", account.ID, "body", "manifest", "headers")
+		if err != nil {
+			return err
+		}
+
+		files, err := sumSizes("files", account.ID, "data")
+		if err != nil {
+			return err
+		}
+
+		// Usage changed while summing means that the sums might be missing
+		// an increment, so the account is left for the next run
+		if err := gorethink.Db(cfg.RethinkDatabase).Table("usage").Get(account.ID).Replace(func(row gorethink.Term) interface{} {
+			replacement := map[string]interface{}{
+				"id":            account.ID,
+				"emails":        emails,
+				"files":         files,
+				"date_modified": gorethink.Now(),
+			}
+
+			if usage.DateModified.IsZero() {
+				return gorethink.Branch(row.Eq(nil), replacement, row)
+			}
+
+			return gorethink.Branch(
+				row.Ne(nil).And(row.Field("date_modified").Eq(usage.DateModified)),
+				replacement,
+				row,
+			)
+		}).Exec(session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sumSizes sums lengths of passed string fields of the owner's documents
+func sumSizes(table string, owner string, fields ...string) (int64, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table(table).GetAllByIndex("owner", owner).Map(func(row gorethink.Term) interface{} {
+		size := gorethink.Expr(0)
+		for _, field := range fields {
+			size = size.Add(row.Field(field).Default("").Count())
+		}
+		return size
+	}).Sum().Run(session)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var sum int64
+	if err := cursor.One(&sum); err != nil {
+		return 0, err
+	}
+
+	return sum, nil
+}
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/alexcesaro/quotedprintable"
+	"github.com/bitly/go-nsq"
+	"github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// Default interval between two replies to the same sender, per RFC 3834
+const defaultVacationDays = 7
+
+// Headers that mark mailing list traffic
+var listHeaders = []string{
+	"List-Id",
+	"List-Help",
+	"List-Subscribe",
+	"List-Unsubscribe",
+	"List-Post",
+	"List-Owner",
+	"List-Archive",
+}
+
+// sendVacationReply queues an automatic reply to the sender of an email if
+// the account has an active vacation responder. Recipient is the envelope
+// recipient that the email was delivered to.
+func sendVacationReply(producer *nsq.Producer, account *models.Account, email *Message, sender string, recipient string, thread string) error {
+	vacation, err := getVacation(account)
+	if err != nil {
+		return err
+	}
+	if vacation == nil || !vacation.Enabled {
+		return nil
+	}
+
+	now := time.Now()
+	if (!vacation.StartDate.IsZero() && now.Before(vacation.StartDate)) ||
+		(!vacation.EndDate.IsZero() && now.After(vacation.EndDate)) {
+		return nil
+	}
+
+	sender = strings.ToLower(sender)
+	if reply, err := shouldAutoReply(account, email, sender); err != nil || !reply {
+		return err
+	}
+
+	// Only reply to the allowed domains
+	if len(vacation.Domains) > 0 {
+		domain := sender[strings.LastIndex(sender, "@")+1:]
+
+		allowed := false
+		for _, value := range vacation.Domains {
+			if strings.ToLower(value) == domain {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil
+		}
+	}
+
+	// Reply to every sender at most once per interval
+	reply, err := getVacationReply(account.ID, sender)
+	if err != nil {
+		return err
+	}
+	days := vacation.Days
+	if days <= 0 {
+		days = defaultVacationDays
+	}
+	if now.Before(reply.Date.Add(time.Duration(days) * 24 * time.Hour)) {
+		return nil
+	}
+
+	// Reply from the address that the email was sent to
+	domain := strings.ToLower(recipient[strings.LastIndex(recipient, "@")+1:])
+	if _, ok := domains[domain]; !ok {
+		return nil
+	}
+
+	subject := vacation.Subject
+	if subject == "" {
+		original := email.Headers.Get("Subject")
+		if len(original) > 1 && original[0] == '=' && original[1] == '?' {
+			if decoded, _, err := quotedprintable.DecodeHeader(original); err == nil {
+				original = decoded
+			}
+		}
+
+		subject = "Auto: " + original
+	}
+
+	id := uniuri.NewLen(uniuri.UUIDLen)
+	es := &Email{
+		Email: models.Email{
+			Resource: models.Resource{
+				ID:           id,
+				DateCreated:  now,
+				DateModified: now,
+				Name:         subject,
+				Owner:        account.ID,
+			},
+			Kind:        "raw",
+			From:        account.Name + "@" + domain,
+			To:          []string{sender},
+			Body:        vacation.Body,
+			ContentType: "text/plain; charset=utf-8",
+			Thread:      thread,
+			MessageID:   id + "@" + domain,
+			Status:      "queued",
+		},
+		AutoSubmitted: "auto-replied",
+	}
+
+	if err := gorethink.Db(cfg.RethinkDatabase).Table("emails").Insert(es).Exec(session); err != nil {
+		return err
+	}
+
+	if err := gorethink.Db(cfg.RethinkDatabase).Table("threads").Get(thread).Update(map[string]interface{}{
+		"emails":        gorethink.Row.Field("emails").Append(id),
+		"date_modified": gorethink.Now(),
+	}).Exec(session); err != nil {
+		return err
+	}
+
+	// Pass it to the outbound queue
+	msg, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	if err := producer.Publish("send_email", msg); err != nil {
+		return err
+	}
+
+	reply.Date = now
+	reply.DateModified = now
+	return gorethink.Db(cfg.RethinkDatabase).Table("vacation_replies").Insert(reply, gorethink.InsertOpts{
+		Conflict: "replace",
+	}).Exec(session)
+}
+
+// shouldAutoReply checks whether an email may be automatically replied to,
+// following section 2 of RFC 3834.
+func shouldAutoReply(account *models.Account, email *Message, sender string) (bool, error) {
+	// Never reply to null senders
+	at := strings.LastIndex(sender, "@")
+	if sender == "" || at == -1 {
+		return false, nil
+	}
+
+	// Nor to the account itself
+	if own, err := isAccountAddress(account, sender); err != nil || own {
+		return false, err
+	}
+
+	// Nor to automated senders
+	local := sender[:at]
+	if local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false, nil
+	}
+
+	// Nor to automatically submitted emails
+	if value := strings.ToLower(strings.TrimSpace(email.Headers.Get("Auto-Submitted"))); value != "" && value != "no" {
+		return false, nil
+	}
+
+	// Nor to bulk and list mail
+	switch strings.ToLower(strings.TrimSpace(email.Headers.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false, nil
+	}
+	for _, header := range listHeaders {
+		if email.Headers.Get(header) != "" {
+			return false, nil
+		}
+	}
+
+	// The account has to be addressed directly
+	for _, field := range []string{"To", "Cc", "Resent-To", "Resent-Cc"} {
+		addresses, err := email.Headers.AddressList(field)
+		if err != nil {
+			continue
+		}
+
+		for _, address := range addresses {
+			if own, err := isAccountAddress(account, address.Address); err != nil || own {
+				return own, err
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// isAccountAddress checks whether the address belongs to the account,
+// including its aliases and plus-addresses. Groups don't count, as their
+// emails aren't addressed to the account directly.
+func isAccountAddress(account *models.Account, address string) (bool, error) {
+	parts := strings.Split(strings.ToLower(address), "@")
+	if len(parts) != 2 {
+		return false, nil
+	}
+
+	if _, ok := domains[parts[1]]; !ok {
+		return false, nil
+	}
+
+	local := parts[0]
+	if i := strings.Index(local, "+"); i != -1 {
+		local = local[:i]
+	}
+	if utils.RemoveDots(utils.NormalizeUsername(local)) == account.Name {
+		return true, nil
+	}
+
+	recipients, err := resolveAddress(address, false)
+	if err == errUnsupportedDomain || err == errUnknownRecipient || err == errGroupLimit {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, recipient := range recipients {
+		if recipient.Group == nil && recipient.Account == account.ID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// getVacation returns the account's vacation responder or nil if there's none
+func getVacation(account *models.Account) (*Vacation, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("vacations").GetAllByIndex("owner", account.ID).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var vacations []*Vacation
+	if err := cursor.All(&vacations); err != nil {
+		return nil, err
+	}
+
+	if len(vacations) == 0 {
+		return nil, nil
+	}
+
+	return vacations[0], nil
+}
+
+// getVacationReply fetches the last reply to a sender or creates a new record
+func getVacationReply(owner string, address string) (*VacationReply, error) {
+	cursor, err := gorethink.Db(cfg.RethinkDatabase).Table("vacation_replies").GetAllByIndex("ownerAddress", []interface{}{
+		owner,
+		address,
+	}).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var replies []*VacationReply
+	if err := cursor.All(&replies); err != nil {
+		return nil, err
+	}
+
+	if len(replies) > 0 {
+		return replies[0], nil
+	}
+
+	return &VacationReply{
+		Resource: models.Resource{
+			ID:          uniuri.NewLen(uniuri.UUIDLen),
+			DateCreated: time.Now(),
+			Owner:       owner,
+		},
+		Address: address,
+	}, nil
+}
@@ -4,7 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/getsentry/raven-go"
 	"github.com/lavab/flag"
@@ -13,6 +17,7 @@ import (
 	"github.com/lavab/mailer/handler"
 	"github.com/lavab/mailer/outbound"
 	"github.com/lavab/mailer/shared"
+	"github.com/lavab/mailer/webhooks"
 )
 
 var (
@@ -26,6 +31,7 @@ var (
 
 	// General settings
 	bindAddress      = flag.String("bind", ":25", "Address used to bind")
+	shutdownTimeout  = flag.Duration("shutdown_timeout", 30*time.Second, "Time given to SMTP sessions and NSQ handlers to finish on shutdown")
 	welcomeMessage   = flag.String("welcome", "Lavaboom Mailer ready.", "Welcome message displayed upon connecting to the server")
 	hostname         = flag.String("hostname", "localhost", "Server hostname")
 	logFormatterType = flag.String("log", "text", "Log formatter type. Either \"json\" or \"text\"")
@@ -64,14 +70,53 @@ var (
 		return address + ":4161"
 	}(), "Address of the lookupd server")
 
+	// redis connection settings
+	redisAddress = flag.String("redis_address", func() string {
+		address := os.Getenv("REDIS_PORT_6379_TCP_ADDR")
+		if address == "" {
+			return ""
+		}
+		return address + ":6379"
+	}(), "Address of the Redis server used for caching. In-memory cache is used if empty")
+	redisDatabase = flag.Int("redis_db", 0, "Index of the Redis database")
+	redisPassword = flag.String("redis_password", "", "Password of the Redis server")
+	cacheExpiry   = flag.Duration("cache_expiry", 10*time.Minute, "Expiry of cached accounts, addresses and keys")
+
 	// smtp relay and spamd addresses
 	smtpAddress  = flag.String("smtp_address", "127.0.0.1:2525", "Address of the SMTP server used for message relaying")
 	spamdAddress = flag.String("spamd_address", "127.0.0.1:783", "Address of the spamd server used for antispam")
+	spamdTimeout = flag.Duration("spamd_timeout", 10*time.Second, "Deadline of spam checks")
+	spamFailOpen = flag.Bool("spam_fail_open", true, "Accept emails without a spam check if spamd is unavailable instead of deferring them")
 
 	// dkim selector, domain and key
 	dkimKey      = flag.String("dkim_key", "", "Path of the DKIM private file")
 	dkimSelector = flag.String("dkim_selector", "default", "DKIM selector")
 
+	// certificates trusted to issue s/mime certificates
+	smimeRoots = flag.String("smime_roots", "", "Path of a PEM bundle of roots trusted to issue S/MIME certificates. System roots are used if empty")
+
+	// sender rewriting scheme settings
+	srsSecret = flag.String("srs_secret", "", "Secret used to sign SRS addresses of forwarded emails. Forwarding is disabled if empty")
+	srsMaxAge = flag.Int("srs_max_age", 21, "Number of days after which SRS addresses expire")
+
+	// interval of storage usage reconciliation
+	usageReconcileInterval = flag.Duration("usage_reconcile_interval", time.Hour, "Interval of recomputing accounts' storage usage")
+
+	// inbound spool settings
+	spoolDirectory = flag.String("spool_dir", "", "Directory of the inbound spool. Emails are processed synchronously if empty")
+	spoolWorkers   = flag.Int("spool_workers", 4, "Number of workers processing the inbound spool")
+	spoolLifetime  = flag.Duration("spool_lifetime", 5*24*time.Hour, "Time after which failing spooled emails are bounced")
+
+	// spam training settings
+	spamTrainingSecret    = flag.String("spam_training_secret", "", "Secret used to encrypt copies of emails kept for spam training. Training is disabled if empty")
+	spamTrainingRetention = flag.Duration("spam_training_retention", 30*24*time.Hour, "Time for which copies of emails are kept for spam training")
+
+	// webhook settings
+	webhookSecret = flag.String("webhook_secret", "", "Secret from which keys signing webhook deliveries are derived. Webhooks are disabled if empty")
+
+	// maintenance commands
+	repairLabelCounters = flag.Bool("repair_label_counters", false, "Recompute label counters from the threads table and exit")
+
 	// raven dsn
 	ravenDSN = flag.String("raven_dsn", "", "DSN of the Raven connection")
 )
@@ -120,6 +165,7 @@ func main() {
 		EtcdKeyFile:      *etcdKeyFile,
 		EtcdPath:         *etcdPath,
 		BindAddress:      *bindAddress,
+		ShutdownTimeout:  *shutdownTimeout,
 		WelcomeMessage:   *welcomeMessage,
 		Hostname:         *hostname,
 		LogFormatterType: *logFormatterType,
@@ -129,20 +175,95 @@ func main() {
 		RethinkDatabase:  *rethinkdbDatabase,
 		NSQDAddress:      *nsqdAddress,
 		LookupdAddress:   *lookupdAddress,
+		RedisAddress:     *redisAddress,
+		RedisDatabase:    *redisDatabase,
+		RedisPassword:    *redisPassword,
+		CacheExpiry:      *cacheExpiry,
 		SMTPAddress:      *smtpAddress,
 		SpamdAddress:     *spamdAddress,
+		SpamdTimeout:     *spamdTimeout,
+		SpamFailOpen:     *spamFailOpen,
 		DKIMKey:          *dkimKey,
 		DKIMSelector:     *dkimSelector,
+		SMIMERoots:       *smimeRoots,
+		SRSSecret:        *srsSecret,
+		SRSMaxAge:        *srsMaxAge,
+
+		UsageReconcileInterval: *usageReconcileInterval,
+
+		SpoolDirectory: *spoolDirectory,
+		SpoolWorkers:   *spoolWorkers,
+		SpoolLifetime:  *spoolLifetime,
+
+		SpamTrainingSecret:    *spamTrainingSecret,
+		SpamTrainingRetention: *spamTrainingRetention,
+
+		WebhookSecret: *webhookSecret,
+	}
+
+	if *repairLabelCounters {
+		if err := handler.RepairLabelCounters(config); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	h := handler.PrepareHandler(config)
+	h, inbound := handler.PrepareHandler(config)
 
 	server := &smtpd.Server{
-		WelcomeMessage: *welcomeMessage,
-		Handler:        h,
+		Hostname:         *hostname,
+		WelcomeMessage:   *welcomeMessage,
+		Handler:          h,
+		RecipientChecker: handler.CheckRecipient,
 	}
 
-	outbound.StartQueue(config)
+	clients := []*shared.NSQClients{
+		inbound,
+		outbound.StartQueue(config),
+	}
+	if dispatcher := webhooks.StartDispatcher(config); dispatcher != nil {
+		clients = append(clients, dispatcher)
+	}
 
-	server.ListenAndServe(*bindAddress)
+	listener, err := net.Listen("tcp", *bindAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	drain := shared.NewDrainListener(listener)
+
+	go func() {
+		if err := server.Serve(drain); err != nil && !drain.Closed() {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a termination signal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Printf("Received %s, shutting down", sig)
+
+	// Stop accepting connections and messages and let the in-flight work
+	// finish. Idle SMTP sessions are closed right away.
+	drain.Close()
+	for _, c := range clients {
+		c.StopConsumers()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		drain.Wait()
+		for _, c := range clients {
+			c.Stop()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Print("Shut down gracefully")
+	case <-time.After(config.ShutdownTimeout):
+		log.Print("Timed out while draining, exiting")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,68 @@
+package outbound
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/mailer/shared"
+	"golang.org/x/crypto/openpgp"
+)
+
+// autocryptKeys returns the Autocrypt keys of all recipients if the Autocrypt
+// recommendation for the message is to encrypt it, nil otherwise.
+func autocryptKeys(session *gorethink.Session, db string, owner string, recipients []string, reply bool) (openpgp.EntityList, error) {
+	recommendations := []string{}
+	keyring := openpgp.EntityList{}
+
+	for _, recipient := range recipients {
+		address := recipient
+		if addr, err := mail.ParseAddress(recipient); err == nil {
+			address = addr.Address
+		}
+		address = strings.ToLower(address)
+
+		cursor, err := gorethink.Db(db).Table("autocrypt_peers").GetAllByIndex("ownerAddress", []interface{}{
+			owner,
+			address,
+		}).Run(session)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+		var peers []*shared.AutocryptPeer
+		if err := cursor.All(&peers); err != nil {
+			return nil, err
+		}
+
+		var peer *shared.AutocryptPeer
+		if len(peers) > 0 {
+			peer = peers[0]
+		}
+
+		// Lavaboom always prefers encryption
+		recommendation := peer.Recommend(true, reply)
+		if recommendation == shared.AutocryptDisable {
+			return nil, nil
+		}
+		recommendations = append(recommendations, recommendation)
+
+		// Peers with unusable keys disable encryption
+		key, err := peer.Key()
+		if err != nil {
+			return nil, nil
+		}
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(key))
+		if err != nil {
+			return nil, nil
+		}
+		keyring = append(keyring, entities...)
+	}
+
+	if shared.CombineRecommendations(recommendations) != shared.AutocryptEncrypt {
+		return nil, nil
+	}
+
+	return keyring, nil
+}
@@ -0,0 +1,13 @@
+package outbound
+
+import (
+	"github.com/lavab/api/models"
+)
+
+// Email is models.Email extended with the metadata recorded by the mailer
+type Email struct {
+	models.Email
+
+	// AutoSubmitted is set on automatically generated emails, such as vacation replies
+	AutoSubmitted string `json:"auto_submitted,omitempty" gorethink:"auto_submitted,omitempty"`
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/mail"
 	"net/smtp"
@@ -22,7 +23,6 @@ import (
 	"github.com/lavab/api/models"
 	"github.com/lavab/mailer/shared"
 	man "github.com/lavab/pgp-manifest-go"
-	"golang.org/x/crypto/openpgp"
 )
 
 var domains = map[string]struct{}{
@@ -31,7 +31,7 @@ var domains = map[string]struct{}{
 	"lavaboom.co":  struct{}{},
 }
 
-func StartQueue(config *shared.Flags) {
+func StartQueue(config *shared.Flags) *shared.NSQClients {
 	// Initialize a new logger
 	log := logrus.New()
 	if config.LogFormatterType == "text" {
@@ -119,7 +119,7 @@ func StartQueue(config *shared.Flags) {
 			return err
 		}
 		defer cursor.Close()
-		var email *models.Email
+		var email *Email
 		if err := cursor.One(&email); err != nil {
 			return err
 		}
@@ -228,6 +228,11 @@ func StartQueue(config *shared.Flags) {
 					context.ReplyTo = email.ReplyTo
 				}
 
+				if email.AutoSubmitted != "" {
+					context.HasAutoSubmitted = true
+					context.AutoSubmitted = email.AutoSubmitted
+				}
+
 				if err := rawSingleTemplate.Execute(buffer, context); err != nil {
 					return err
 				}
@@ -287,35 +292,100 @@ func StartQueue(config *shared.Flags) {
 				return err
 			}
 
-			// Get owner's key
-			var key *models.Key
-			if account.PublicKey != "" {
-				cursor, err = gorethink.Db(config.RethinkDatabase).Table("keys").Get(account.PublicKey).Run(session)
-				if err != nil {
-					return err
+			// Get owner's keys
+			cursor, err = gorethink.Db(config.RethinkDatabase).Table("keys").GetAllByIndex("owner", account.ID).Run(session)
+			if err != nil {
+				return err
+			}
+			defer cursor.Close()
+			var keys []*models.Key
+			if err := cursor.All(&keys); err != nil {
+				return err
+			}
+
+			// Use every valid encryption key of the owner
+			keyring := shared.EncryptionKeys(keys)
+			if len(keyring) == 0 {
+				return fmt.Errorf("Account %s has no usable public key", account.ID)
+			}
+
+			// Encrypt the email using PGP/MIME if Autocrypt recommends it
+			peers := append(append([]string{}, email.To...), email.CC...)
+			peerKeys, err := autocryptKeys(session, config.RethinkDatabase, account.ID, peers, thread.Secure == "all")
+			if err != nil {
+				return err
+			}
+			if peerKeys != nil {
+				// Render the entity that gets encrypted
+				inner := &bytes.Buffer{}
+
+				innerContext := &rawInnerContext{
+					Boundary1:   uniuri.NewLen(20),
+					ContentType: email.ContentType,
+					Body:        quotedprintable.EncodeToString([]byte(email.Body)),
 				}
-				defer cursor.Close()
-				if err := cursor.One(&key); err != nil {
+
+				for _, file := range files {
+					innerContext.Files = append(innerContext.Files, &emailFile{
+						Encoding: file.Encoding,
+						Name:     file.Name,
+						Body:     base64.StdEncoding.EncodeToString([]byte(file.Data)),
+					})
+				}
+
+				if err := rawInnerTemplate.Execute(inner, innerContext); err != nil {
 					return err
 				}
-			} else {
-				cursor, err = gorethink.Db(config.RethinkDatabase).Table("keys").GetAllByIndex("owner", account.ID).Run(session)
+
+				// Encrypt it to the recipients and the sender
+				cipher, err := shared.EncryptAndArmor(inner.Bytes(), append(peerKeys, keyring...))
 				if err != nil {
 					return err
 				}
-				defer cursor.Close()
-				var keys []*models.Key
-				if err := cursor.All(&keys); err != nil {
+
+				boundary := uniuri.NewLen(20)
+				body := &bytes.Buffer{}
+				if err := pgpMimeBodyTemplate.Execute(body, &pgpMimeBodyContext{
+					Boundary1: boundary,
+					Body:      string(cipher),
+				}); err != nil {
 					return err
 				}
 
-				key = keys[0]
-			}
+				buffer := &bytes.Buffer{}
 
-			// Parse the key
-			keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
-			if err != nil {
-				return err
+				context := &pgpContext{
+					From:         ctxFrom,
+					CombinedTo:   strings.Join(email.To, ", "),
+					MessageID:    email.MessageID,
+					HasInReplyTo: hasInReplyTo,
+					InReplyTo:    inReplyTo,
+					Subject:      he.Encode(email.Name),
+					ContentType:  `multipart/encrypted; protocol="application/pgp-encrypted"; boundary="` + boundary + `"`,
+					Body:         body.String(),
+					Date:         email.DateCreated.Format(time.RubyDate),
+				}
+
+				if email.CC != nil && len(email.CC) > 0 {
+					context.HasCC = true
+					context.CombinedCC = strings.Join(email.CC, ", ")
+				}
+
+				if email.ReplyTo != "" {
+					context.HasReplyTo = true
+					context.ReplyTo = email.ReplyTo
+				}
+
+				if email.AutoSubmitted != "" {
+					context.HasAutoSubmitted = true
+					context.AutoSubmitted = email.AutoSubmitted
+				}
+
+				if err := pgpTemplate.Execute(buffer, context); err != nil {
+					return err
+				}
+
+				contents = buffer.String()
 			}
 
 			// From, to and cc parsing
@@ -592,7 +662,18 @@ func StartQueue(config *shared.Flags) {
 			}
 		}
 
-		if err := smtp.SendMail(config.SMTPAddress, nil, email.From, recipients, []byte(contents)); err != nil {
+		// Encode the email ID in the envelope sender (VERP) to match bounces
+		envelopeFrom := email.From
+		if i := strings.LastIndex(email.From, "@"); i != -1 {
+			envelopeFrom = email.From[:i] + "+bounce-" + email.ID + email.From[i:]
+		}
+
+		// Automatic responses are sent with a null envelope sender (RFC 3834)
+		if email.AutoSubmitted != "" {
+			envelopeFrom = ""
+		}
+
+		if err := smtp.SendMail(config.SMTPAddress, nil, envelopeFrom, recipients, []byte(contents)); err != nil {
 			err := producer.Publish("email_bounced", nsqmsg)
 			if err != nil {
 				log.WithFields(logrus.Fields{
@@ -628,6 +709,11 @@ func StartQueue(config *shared.Flags) {
 	}
 
 	log.Info("Connected to NSQ and awaiting data")
+
+	return &shared.NSQClients{
+		Consumers: []*nsq.Consumer{consumer},
+		Producers: []*nsq.Producer{producer},
+	}
 }
 
 /*func ResolveDomain(domain string) (string, error) {
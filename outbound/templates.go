@@ -5,19 +5,21 @@ import (
 )
 
 type rawSingleContext struct {
-	From         string
-	CombinedTo   string
-	HasCC        bool
-	CombinedCC   string
-	HasReplyTo   bool
-	ReplyTo      string
-	MessageID    string
-	HasInReplyTo bool
-	InReplyTo    string
-	Subject      string
-	ContentType  string
-	Body         string
-	Date         string
+	From             string
+	CombinedTo       string
+	HasCC            bool
+	CombinedCC       string
+	HasReplyTo       bool
+	ReplyTo          string
+	MessageID        string
+	HasInReplyTo     bool
+	InReplyTo        string
+	HasAutoSubmitted bool
+	AutoSubmitted    string
+	Subject          string
+	ContentType      string
+	Body             string
+	Date             string
 }
 
 var rawSingleTemplate = template.Must(template.New("rawsingle").Parse(
@@ -28,7 +30,8 @@ Reply-To: {{.ReplyTo}}{{end}}
 MIME-Version: 1.0
 Message-ID: <{{.MessageID}}>{{if .HasInReplyTo}}
 In-Reply-To: {{.InReplyTo}}
-References: {{.InReplyTo}}{{end}}
+References: {{.InReplyTo}}{{end}}{{if .HasAutoSubmitted}}
+Auto-Submitted: {{.AutoSubmitted}}{{end}}
 Content-Type: {{.ContentType}}
 Content-Transfer-Encoding: quoted-printable
 Subject: {{.Subject}}
@@ -86,19 +89,21 @@ Content-Disposition: attachment; filename="{{.Name}}"
 `))
 
 type pgpContext struct {
-	From         string
-	CombinedTo   string
-	HasCC        bool
-	CombinedCC   string
-	HasReplyTo   bool
-	ReplyTo      string
-	MessageID    string
-	HasInReplyTo bool
-	InReplyTo    string
-	ContentType  string
-	Subject      string
-	Body         string
-	Date         string
+	From             string
+	CombinedTo       string
+	HasCC            bool
+	CombinedCC       string
+	HasReplyTo       bool
+	ReplyTo          string
+	MessageID        string
+	HasInReplyTo     bool
+	InReplyTo        string
+	HasAutoSubmitted bool
+	AutoSubmitted    string
+	ContentType      string
+	Subject          string
+	Body             string
+	Date             string
 }
 
 var pgpTemplate = template.Must(template.New("rawmulti").Parse(
@@ -109,7 +114,8 @@ Reply-To: {{.ReplyTo}}{{end}}
 MIME-Version: 1.0
 Message-ID: <{{.MessageID}}>{{if .HasInReplyTo}}
 In-Reply-To: {{.InReplyTo}}
-References: {{.InReplyTo}}{{end}}
+References: {{.InReplyTo}}{{end}}{{if .HasAutoSubmitted}}
+Auto-Submitted: {{.AutoSubmitted}}{{end}}
 Content-Type: {{.ContentType}}
 Subject: {{.Subject}}
 Date: {{.Date}}
@@ -117,6 +123,54 @@ Date: {{.Date}}
 {{.Body}}
 `))
 
+type rawInnerContext struct {
+	Boundary1   string
+	ContentType string
+	Body        string
+	Files       []*emailFile
+}
+
+var rawInnerTemplate = template.Must(template.New("rawinner").Parse(
+	`{{if .Files}}Content-Type: multipart/mixed; boundary="{{.Boundary1}}"
+
+--{{.Boundary1}}
+Content-Type: {{.ContentType}}
+Content-Transfer-Encoding: quoted-printable
+
+{{.Body}}
+{{ range .Files }}--{{$.Boundary1}}
+Content-Type: {{.Encoding}}
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="{{.Name}}"
+
+{{.Body}}
+{{ end }}--{{.Boundary1}}--
+{{else}}Content-Type: {{.ContentType}}
+Content-Transfer-Encoding: quoted-printable
+
+{{.Body}}
+{{end}}`))
+
+type pgpMimeBodyContext struct {
+	Boundary1 string
+	Body      string
+}
+
+var pgpMimeBodyTemplate = template.Must(template.New("pgpmimebody").Parse(
+	`--{{.Boundary1}}
+Content-Type: application/pgp-encrypted
+Content-Description: PGP/MIME version identification
+
+Version: 1
+
+--{{.Boundary1}}
+Content-Type: application/octet-stream; name="encrypted.asc"
+Content-Description: OpenPGP encrypted message
+Content-Disposition: inline; filename="encrypted.asc"
+
+{{.Body}}
+--{{.Boundary1}}--`))
+
 type manifestSingleContext struct {
 	From         string
 	CombinedTo   string
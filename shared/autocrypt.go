@@ -0,0 +1,193 @@
+package shared
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lavab/api/models"
+)
+
+// Autocrypt Level 1 recommendations
+const (
+	AutocryptDisable    = "disable"
+	AutocryptDiscourage = "discourage"
+	AutocryptAvailable  = "available"
+	AutocryptEncrypt    = "encrypt"
+)
+
+// Autocrypt Level 1 prefer-encrypt values
+const (
+	PreferEncryptMutual       = "mutual"
+	PreferEncryptNoPreference = "nopreference"
+)
+
+// Keys older than this compared to the last seen message are considered stale
+const autocryptStaleAfter = 35 * 24 * time.Hour
+
+// AutocryptHeader is a parsed Autocrypt or Autocrypt-Gossip header
+type AutocryptHeader struct {
+	Address       string
+	PreferEncrypt string
+	KeyData       []byte
+}
+
+// ParseAutocryptHeader parses a value of an Autocrypt header as specified in
+// the Autocrypt Level 1 spec.
+func ParseAutocryptHeader(value string) (*AutocryptHeader, error) {
+	header := &AutocryptHeader{
+		PreferEncrypt: PreferEncryptNoPreference,
+	}
+
+	for _, attribute := range strings.Split(value, ";") {
+		attribute = strings.TrimSpace(attribute)
+		if attribute == "" {
+			continue
+		}
+
+		parts := strings.SplitN(attribute, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid Autocrypt attribute")
+		}
+
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		switch key {
+		case "addr":
+			header.Address = strings.ToLower(strings.TrimSpace(parts[1]))
+		case "prefer-encrypt":
+			if strings.TrimSpace(parts[1]) == PreferEncryptMutual {
+				header.PreferEncrypt = PreferEncryptMutual
+			}
+		case "keydata":
+			// Remove folding whitespace from the key
+			data := strings.Map(func(r rune) rune {
+				if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+					return -1
+				}
+				return r
+			}, parts[1])
+
+			keyData, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, err
+			}
+
+			header.KeyData = keyData
+		default:
+			// Unknown critical attributes invalidate the header
+			if !strings.HasPrefix(key, "_") {
+				return nil, errors.New("Unknown critical Autocrypt attribute " + key)
+			}
+		}
+	}
+
+	if header.Address == "" || len(header.KeyData) == 0 {
+		return nil, errors.New("Autocrypt header is missing addr or keydata")
+	}
+
+	return header, nil
+}
+
+// AutocryptPeer is the Autocrypt state that an account keeps about a peer
+type AutocryptPeer struct {
+	models.Resource
+
+	Address string `json:"address" gorethink:"address"`
+
+	LastSeen           time.Time `json:"last_seen" gorethink:"last_seen"`
+	AutocryptTimestamp time.Time `json:"autocrypt_timestamp" gorethink:"autocrypt_timestamp"`
+	PublicKey          string    `json:"public_key" gorethink:"public_key"` // Base64-encoded key
+	PreferEncrypt      string    `json:"prefer_encrypt" gorethink:"prefer_encrypt"`
+
+	GossipTimestamp time.Time `json:"gossip_timestamp" gorethink:"gossip_timestamp"`
+	GossipKey       string    `json:"gossip_key" gorethink:"gossip_key"` // Base64-encoded key
+}
+
+// Update applies a message from the peer with its effective date. Header
+// should be nil if the message had no valid Autocrypt header.
+func (p *AutocryptPeer) Update(header *AutocryptHeader, date time.Time) {
+	// Messages older than the current key don't change anything
+	if date.Before(p.AutocryptTimestamp) {
+		return
+	}
+
+	if date.After(p.LastSeen) {
+		p.LastSeen = date
+	}
+
+	if header == nil {
+		return
+	}
+
+	p.AutocryptTimestamp = date
+	p.PublicKey = base64.StdEncoding.EncodeToString(header.KeyData)
+	p.PreferEncrypt = header.PreferEncrypt
+}
+
+// UpdateGossip applies an Autocrypt-Gossip header about the peer
+func (p *AutocryptPeer) UpdateGossip(header *AutocryptHeader, date time.Time) {
+	if !date.After(p.GossipTimestamp) {
+		return
+	}
+
+	p.GossipTimestamp = date
+	p.GossipKey = base64.StdEncoding.EncodeToString(header.KeyData)
+}
+
+// Key returns the key that should be used to encrypt messages to the peer
+func (p *AutocryptPeer) Key() ([]byte, error) {
+	if p.PublicKey != "" {
+		return base64.StdEncoding.DecodeString(p.PublicKey)
+	}
+
+	return base64.StdEncoding.DecodeString(p.GossipKey)
+}
+
+// Recommend returns the encryption recommendation for a message to the peer.
+// Mutual is the sender's own prefer-encrypt setting and reply tells whether
+// the message is a reply to an encrypted one.
+func (p *AutocryptPeer) Recommend(mutual bool, reply bool) string {
+	if p == nil || (p.PublicKey == "" && p.GossipKey == "") {
+		return AutocryptDisable
+	}
+
+	preliminary := AutocryptDiscourage
+	if p.PublicKey != "" && !p.AutocryptTimestamp.Add(autocryptStaleAfter).Before(p.LastSeen) {
+		preliminary = AutocryptAvailable
+	}
+
+	if preliminary == AutocryptAvailable && mutual && p.PreferEncrypt == PreferEncryptMutual {
+		return AutocryptEncrypt
+	}
+
+	if reply {
+		return AutocryptEncrypt
+	}
+
+	return preliminary
+}
+
+// CombineRecommendations merges recommendations for every recipient of a
+// message into a single one.
+func CombineRecommendations(recommendations []string) string {
+	if len(recommendations) == 0 {
+		return AutocryptDisable
+	}
+
+	result := AutocryptEncrypt
+	for _, recommendation := range recommendations {
+		switch recommendation {
+		case AutocryptDisable:
+			return AutocryptDisable
+		case AutocryptDiscourage:
+			result = AutocryptDiscourage
+		case AutocryptAvailable:
+			if result == AutocryptEncrypt {
+				result = AutocryptAvailable
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,169 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutocryptRecommend(t *testing.T) {
+	now := time.Now()
+	key := &AutocryptHeader{
+		Address:       "peer@example.com",
+		PreferEncrypt: PreferEncryptMutual,
+		KeyData:       []byte("key"),
+	}
+
+	tests := []struct {
+		name   string
+		peer   func() *AutocryptPeer
+		mutual bool
+		reply  bool
+		want   string
+	}{
+		{
+			name: "unknown peer",
+			peer: func() *AutocryptPeer {
+				return nil
+			},
+			want: AutocryptDisable,
+		},
+		{
+			name: "peer without a key",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.Update(nil, now)
+				return p
+			},
+			reply: true,
+			want:  AutocryptDisable,
+		},
+		{
+			name: "stale key",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.Update(key, now.Add(-60*24*time.Hour))
+				p.Update(nil, now)
+				return p
+			},
+			mutual: true,
+			want:   AutocryptDiscourage,
+		},
+		{
+			name: "gossip key only",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.UpdateGossip(key, now)
+				return p
+			},
+			mutual: true,
+			want:   AutocryptDiscourage,
+		},
+		{
+			name: "fresh key",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.Update(key, now)
+				return p
+			},
+			want: AutocryptAvailable,
+		},
+		{
+			name: "fresh key without the peer's preference",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.Update(&AutocryptHeader{
+					Address:       key.Address,
+					PreferEncrypt: PreferEncryptNoPreference,
+					KeyData:       key.KeyData,
+				}, now)
+				return p
+			},
+			mutual: true,
+			want:   AutocryptAvailable,
+		},
+		{
+			name: "mutual preference",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.Update(key, now)
+				return p
+			},
+			mutual: true,
+			want:   AutocryptEncrypt,
+		},
+		{
+			name: "reply to an encrypted message",
+			peer: func() *AutocryptPeer {
+				p := &AutocryptPeer{}
+				p.Update(key, now.Add(-60*24*time.Hour))
+				p.Update(nil, now)
+				return p
+			},
+			reply: true,
+			want:  AutocryptEncrypt,
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.peer().Recommend(test.mutual, test.reply); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAutocryptUpdateIgnoresOlderMessages(t *testing.T) {
+	now := time.Now()
+
+	p := &AutocryptPeer{}
+	p.Update(&AutocryptHeader{
+		Address:       "peer@example.com",
+		PreferEncrypt: PreferEncryptMutual,
+		KeyData:       []byte("new"),
+	}, now)
+
+	p.Update(&AutocryptHeader{
+		Address:       "peer@example.com",
+		PreferEncrypt: PreferEncryptNoPreference,
+		KeyData:       []byte("old"),
+	}, now.Add(-time.Hour))
+
+	key, err := p.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "new" {
+		t.Errorf("older message replaced the key with %q", key)
+	}
+	if p.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("older message replaced prefer-encrypt with %s", p.PreferEncrypt)
+	}
+	if !p.AutocryptTimestamp.Equal(now) || !p.LastSeen.Equal(now) {
+		t.Errorf("older message moved the timestamps to %s and %s", p.AutocryptTimestamp, p.LastSeen)
+	}
+
+	p.UpdateGossip(&AutocryptHeader{KeyData: []byte("gossip")}, now)
+	p.UpdateGossip(&AutocryptHeader{KeyData: []byte("old gossip")}, now.Add(-time.Hour))
+	if p.GossipKey != "Z29zc2lw" {
+		t.Errorf("older gossip replaced the key with %s", p.GossipKey)
+	}
+}
+
+func TestCombineRecommendations(t *testing.T) {
+	tests := []struct {
+		input []string
+		want  string
+	}{
+		{nil, AutocryptDisable},
+		{[]string{AutocryptEncrypt, AutocryptEncrypt}, AutocryptEncrypt},
+		{[]string{AutocryptEncrypt, AutocryptAvailable}, AutocryptAvailable},
+		{[]string{AutocryptAvailable, AutocryptDiscourage, AutocryptEncrypt}, AutocryptDiscourage},
+		{[]string{AutocryptDiscourage, AutocryptAvailable}, AutocryptDiscourage},
+		{[]string{AutocryptEncrypt, AutocryptDisable, AutocryptDiscourage}, AutocryptDisable},
+	}
+
+	for _, test := range tests {
+		if got := CombineRecommendations(test.input); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.input, got, test.want)
+		}
+	}
+}
@@ -1,5 +1,9 @@
 package shared
 
+import (
+	"time"
+)
+
 type Flags struct {
 	EtcdAddress  string
 	EtcdCAFile   string
@@ -8,6 +12,7 @@ type Flags struct {
 	EtcdPath     string
 
 	BindAddress      string
+	ShutdownTimeout  time.Duration
 	WelcomeMessage   string
 	Hostname         string
 	LogFormatterType string
@@ -20,9 +25,32 @@ type Flags struct {
 	NSQDAddress    string
 	LookupdAddress string
 
+	RedisAddress  string
+	RedisDatabase int
+	RedisPassword string
+	CacheExpiry   time.Duration
+
 	SMTPAddress  string
 	SpamdAddress string
+	SpamdTimeout time.Duration
+	SpamFailOpen bool
 
 	DKIMKey      string
 	DKIMSelector string
+
+	SMIMERoots string
+
+	SRSSecret string
+	SRSMaxAge int
+
+	UsageReconcileInterval time.Duration
+
+	SpoolDirectory string
+	SpoolWorkers   int
+	SpoolLifetime  time.Duration
+
+	SpamTrainingSecret    string
+	SpamTrainingRetention time.Duration
+
+	WebhookSecret string
 }
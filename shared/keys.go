@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lavab/api/models"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// EncryptionKeys parses passed keys and returns an entity for every currently
+// valid encryption-capable key or subkey. Expired and revoked keys are
+// skipped. Every returned entity resolves to exactly one key when passed to
+// openpgp.Encrypt.
+func EncryptionKeys(keys []*models.Key) openpgp.EntityList {
+	now := time.Now()
+	result := openpgp.EntityList{}
+
+	for _, key := range keys {
+		// Zero expiry date means that the key never expires
+		if !key.ExpiryDate.IsZero() && key.Expired() {
+			continue
+		}
+
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
+		if err != nil {
+			continue
+		}
+
+		for _, entity := range entities {
+			if len(entity.Revocations) > 0 {
+				continue
+			}
+
+			identity := primaryIdentity(entity)
+			if identity == nil || identity.SelfSignature.KeyExpired(now) {
+				continue
+			}
+
+			// Keys without the key flags subpacket can be used for anything
+			// that their algorithm allows
+			usable := 0
+			for _, subkey := range entity.Subkeys {
+				if subkey.Sig.SigType == packet.SigTypeSubkeyRevocation ||
+					(subkey.Sig.FlagsValid && !subkey.Sig.FlagEncryptCommunications) ||
+					!subkey.PublicKey.PubKeyAlgo.CanEncrypt() ||
+					subkey.Sig.KeyExpired(now) {
+					continue
+				}
+
+				// openpgp.Encrypt skips subkeys without flags, so they're set
+				// on a copy of the binding signature
+				if !subkey.Sig.FlagsValid {
+					sig := *subkey.Sig
+					sig.FlagsValid = true
+					sig.FlagEncryptCommunications = true
+					subkey.Sig = &sig
+				}
+
+				result = append(result, &openpgp.Entity{
+					PrimaryKey: entity.PrimaryKey,
+					Identities: entity.Identities,
+					Subkeys:    []openpgp.Subkey{subkey},
+				})
+				usable++
+			}
+
+			// Primary key is used if it's explicitly allowed to encrypt or
+			// if it has no flags and there's no usable subkey
+			sig := identity.SelfSignature
+			if entity.PrimaryKey.PubKeyAlgo.CanEncrypt() &&
+				((sig.FlagsValid && sig.FlagEncryptCommunications) || (!sig.FlagsValid && usable == 0)) {
+				result = append(result, &openpgp.Entity{
+					PrimaryKey: entity.PrimaryKey,
+					Identities: entity.Identities,
+				})
+			}
+		}
+	}
+
+	return result
+}
+
+// primaryIdentity returns the identity marked as primary or the first one
+func primaryIdentity(entity *openpgp.Entity) *openpgp.Identity {
+	var first *openpgp.Identity
+	for _, identity := range entity.Identities {
+		if identity.SelfSignature == nil {
+			continue
+		}
+
+		if identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return identity
+		}
+
+		if first == nil {
+			first = identity
+		}
+	}
+
+	return first
+}
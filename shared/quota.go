@@ -0,0 +1,23 @@
+package shared
+
+import (
+	"github.com/lavab/api/models"
+)
+
+// Storage quotas of account types in bytes. Zero means no limit.
+var Quotas = map[string]int64{
+	"std":       512 << 20,
+	"beta":      1 << 30,
+	"premium":   10 << 30,
+	"superuser": 0,
+}
+
+// Quota returns the storage quota of an account in bytes. Billing data isn't
+// taken into account yet, as the API doesn't define any.
+func Quota(account *models.Account) int64 {
+	if quota, ok := Quotas[account.Type]; ok {
+		return quota
+	}
+
+	return Quotas["std"]
+}
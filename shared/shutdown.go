@@ -0,0 +1,289 @@
+package shared
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// NSQClients are consumers and producers that have to be stopped before
+// the process exits, along with workers that publish using the producers
+type NSQClients struct {
+	Consumers []*nsq.Consumer
+	Producers []*nsq.Producer
+	Workers   []Stopper
+}
+
+// Stopper is a background worker. Stop blocks until its work is finished.
+type Stopper interface {
+	Stop()
+}
+
+// StopConsumers makes the consumers stop taking new messages. It doesn't
+// wait for the ones that are being handled.
+func (c *NSQClients) StopConsumers() {
+	for _, consumer := range c.Consumers {
+		consumer.Stop()
+	}
+}
+
+// Stop lets the consumers finish messages that are being handled, stops
+// the workers and then the producers, whose publishes are done by then.
+func (c *NSQClients) Stop() {
+	c.StopConsumers()
+	for _, consumer := range c.Consumers {
+		<-consumer.StopChan
+	}
+
+	for _, worker := range c.Workers {
+		worker.Stop()
+	}
+
+	for _, producer := range c.Producers {
+		producer.Stop()
+	}
+}
+
+const (
+	// Maximal length of a tracked SMTP command line
+	maxCommandLength = 1024
+
+	// Time after which TLS sessions without any traffic are closed once the
+	// listener is closed
+	tlsIdleTimeout = 5 * time.Second
+)
+
+// DrainListener tracks connections accepted by a listener, so that they
+// can be waited for after the listener is closed. Connections waiting for
+// the next SMTP command are closed along with the listener, while those
+// transferring or delivering a message are left to finish. Commands can't
+// be followed after STARTTLS, so TLS sessions are closed once the client
+// stops sending anything for TLSIdleTimeout.
+type DrainListener struct {
+	net.Listener
+	TLSIdleTimeout time.Duration
+
+	lock   sync.Mutex
+	closed bool
+	conns  map[*drainConn]struct{}
+	active sync.WaitGroup
+}
+
+// NewDrainListener wraps the listener
+func NewDrainListener(listener net.Listener) *DrainListener {
+	return &DrainListener{
+		Listener:       listener,
+		TLSIdleTimeout: tlsIdleTimeout,
+		conns:          map[*drainConn]struct{}{},
+	}
+}
+
+// Accept waits for the next connection and tracks it until it's closed
+func (l *DrainListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := &drainConn{
+		Conn:     conn,
+		listener: l,
+	}
+
+	l.lock.Lock()
+	l.conns[wrapped] = struct{}{}
+	l.lock.Unlock()
+
+	l.active.Add(1)
+	return wrapped, nil
+}
+
+// Close stops accepting new connections and closes idle ones
+func (l *DrainListener) Close() error {
+	l.lock.Lock()
+	l.closed = true
+	conns := []*drainConn{}
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.lock.Unlock()
+
+	err := l.Listener.Close()
+
+	for _, conn := range conns {
+		conn.lock.Lock()
+		idle := conn.idle()
+		opaque := conn.opaque
+		conn.lock.Unlock()
+
+		if idle {
+			conn.shutdown()
+		} else if opaque {
+			conn.expire(l.TLSIdleTimeout)
+		}
+	}
+
+	return err
+}
+
+// Closed tells whether the listener was closed using Close
+func (l *DrainListener) Closed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.closed
+}
+
+// Wait blocks until all accepted connections are closed
+func (l *DrainListener) Wait() {
+	l.active.Wait()
+}
+
+// drainConn follows the SMTP session to tell whether it's idle, ie. the
+// server waits for the next command outside of DATA
+type drainConn struct {
+	net.Conn
+
+	listener *DrainListener
+	once     sync.Once
+	shutOnce sync.Once
+
+	lock        sync.Mutex
+	line        []byte // Incomplete line sent by the client
+	dataPending bool   // DATA was sent, but the server didn't reply yet
+	data        bool   // Client is sending the message
+	opaque      bool   // Commands can't be followed after STARTTLS
+	waiting     bool   // Server is blocked reading from the client
+	reads       int    // Number of reads that returned any data
+}
+
+func (c *drainConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	c.waiting = true
+	idle := c.idle()
+	c.lock.Unlock()
+
+	// Sessions that get idle after the listener was closed end right away
+	if idle && c.listener.Closed() {
+		c.shutdown()
+		return 0, io.EOF
+	}
+
+	n, err := c.Conn.Read(b)
+
+	c.lock.Lock()
+	c.waiting = false
+	if n > 0 {
+		c.reads++
+	}
+	c.follow(b[:n])
+	c.lock.Unlock()
+
+	return n, err
+}
+
+func (c *drainConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	if c.dataPending {
+		// DATA might have been rejected, eg. without any recipients
+		c.data = bytes.HasPrefix(b, []byte("354"))
+		c.dataPending = false
+	}
+	c.lock.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+func (c *drainConn) Close() error {
+	c.listener.lock.Lock()
+	delete(c.listener.conns, c)
+	c.listener.lock.Unlock()
+
+	err := c.Conn.Close()
+	c.once.Do(c.listener.active.Done)
+	return err
+}
+
+// idle has to be called with the lock held
+func (c *drainConn) idle() bool {
+	return c.waiting && !c.dataPending && !c.data && !c.opaque
+}
+
+// follow tracks DATA in lines sent by the client. It has to be called with
+// the lock held.
+func (c *drainConn) follow(b []byte) {
+	for _, char := range b {
+		if char != '\n' {
+			if len(c.line) < maxCommandLength {
+				c.line = append(c.line, char)
+			}
+			continue
+		}
+
+		line := strings.TrimRight(string(c.line), "\r")
+		c.line = c.line[:0]
+
+		if c.data {
+			if line == "." {
+				c.data = false
+			}
+			continue
+		}
+
+		switch strings.ToUpper(strings.TrimSpace(line)) {
+		case "DATA":
+			c.dataPending = true
+		case "STARTTLS":
+			c.opaque = true
+		}
+	}
+}
+
+// expire shuts the TLS session down once the server waits for the client,
+// which doesn't send anything for the timeout. Sessions that are still
+// active are checked again after another timeout, until they're closed.
+func (c *drainConn) expire(timeout time.Duration) {
+	c.lock.Lock()
+	reads := c.reads
+	c.lock.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		c.listener.lock.Lock()
+		_, open := c.listener.conns[c]
+		c.listener.lock.Unlock()
+		if !open {
+			return
+		}
+
+		c.lock.Lock()
+		expired := c.waiting && c.reads == reads
+		c.lock.Unlock()
+
+		if expired {
+			c.shutdown()
+		} else {
+			c.expire(timeout)
+		}
+	})
+}
+
+// shutdown tells the client that the server is going away and closes the
+// underlying connection, which ends the session. The reply can't be sent
+// in plain text after STARTTLS, so such sessions are just closed.
+func (c *drainConn) shutdown() {
+	c.shutOnce.Do(func() {
+		c.lock.Lock()
+		opaque := c.opaque
+		c.lock.Unlock()
+
+		if !opaque {
+			c.Conn.Write([]byte("421 Service shutting down\r\n"))
+		}
+		c.Conn.Close()
+	})
+}
@@ -0,0 +1,192 @@
+package shared
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lavab/smtpd"
+)
+
+func dialSMTP(t *testing.T, address string, commands ...string) *textproto.Conn {
+	conn, err := textproto.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, command := range commands {
+		code := 250
+		if command == "DATA" {
+			code = 354
+		}
+
+		if err := conn.PrintfLine("%s", command); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+	}
+
+	return conn
+}
+
+func expectShutdown(t *testing.T, name string, conn *textproto.Conn) {
+	code, _, err := conn.ReadResponse(421)
+	if err != nil {
+		t.Errorf("%s: Expected 421, got %d %v", name, code, err)
+	}
+	if _, err := conn.ReadLine(); err == nil {
+		t.Errorf("%s: Connection is still open", name)
+	}
+}
+
+func TestDrainListenerClosesIdleSessions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain := NewDrainListener(listener)
+
+	delivered := make(chan string, 1)
+	server := &smtpd.Server{
+		Handler: func(peer smtpd.Peer, e smtpd.Envelope) error {
+			delivered <- string(e.Data)
+			return nil
+		},
+	}
+	go server.Serve(drain)
+
+	address := listener.Addr().String()
+	idle := dialSMTP(t, address, "EHLO localhost")
+	rejected := dialSMTP(t, address, "HELO localhost", "MAIL FROM:<a@example.com>")
+	sending := dialSMTP(t, address, "HELO localhost", "MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "DATA")
+	defer idle.Close()
+	defer rejected.Close()
+	defer sending.Close()
+
+	// DATA without recipients is rejected, which leaves the session idle
+	if err := rejected.PrintfLine("DATA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rejected.ReadResponse(502); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sending.PrintfLine("Subject: Test\r\n\r\nDATA\r\nQUIT"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session is in DATA since the server replied with 354, so lines of
+	// the message aren't taken for commands whenever they're read
+	drain.Close()
+
+	expectShutdown(t, "idle", idle)
+	expectShutdown(t, "rejected", rejected)
+
+	waited := make(chan struct{})
+	go func() {
+		drain.Wait()
+		close(waited)
+	}()
+
+	// The message that was being sent gets delivered. The session waits for
+	// its end, so the listener can't be drained yet.
+	select {
+	case <-waited:
+		t.Fatal("Listener drained before the message was delivered")
+	default:
+	}
+
+	if err := sending.PrintfLine("."); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sending.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-delivered; !strings.Contains(data, "\nDATA\nQUIT\n") {
+		t.Errorf("Unexpected message %q", data)
+	}
+	expectShutdown(t, "sending", sending)
+
+	<-waited
+}
+
+// testCertificate creates a self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestDrainListenerClosesIdleTLSSessions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain := NewDrainListener(listener)
+	drain.TLSIdleTimeout = 10 * time.Millisecond
+
+	server := &smtpd.Server{
+		Handler: func(peer smtpd.Peer, e smtpd.Envelope) error {
+			return nil
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t)},
+		},
+	}
+	go server.Serve(drain)
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session waits for the next command over TLS
+	drain.Close()
+	drain.Wait()
+
+	if err := client.Noop(); err == nil {
+		t.Error("TLS session is still open")
+	}
+}
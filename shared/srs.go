@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Alphabet used to encode SRS timestamps
+const srsTimestampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// SRS timestamps wrap around after 1024 days
+const srsTimestampCycle = 1024
+
+// SRS rewrites envelope senders of forwarded emails using the Sender
+// Rewriting Scheme, so that SPF checks pass at the destination.
+type SRS struct {
+	Secret []byte
+	MaxAge int // Days after which a rewritten address stops being accepted
+}
+
+// IsSRS checks whether the local part of an address is SRS encoded
+func IsSRS(address string) bool {
+	upper := strings.ToUpper(address)
+	return strings.HasPrefix(upper, "SRS0=") || strings.HasPrefix(upper, "SRS1=")
+}
+
+// Forward rewrites a sender address to an SRS0 address in passed domain
+func (s *SRS) Forward(sender string, domain string) (string, error) {
+	at := strings.LastIndex(sender, "@")
+	if at == -1 {
+		return "", errors.New("Invalid sender address")
+	}
+
+	var (
+		local     = sender[:at]
+		host      = sender[at+1:]
+		timestamp = srsTimestamp(time.Now())
+	)
+
+	return "SRS0=" + s.hash(timestamp, host, local) + "=" + timestamp + "=" + host + "=" + local + "@" + domain, nil
+}
+
+// Reverse decodes an SRS0 address back into the original sender
+func (s *SRS) Reverse(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return "", errors.New("Invalid SRS address")
+	}
+	local := address[:at]
+
+	if !strings.HasPrefix(strings.ToUpper(local), "SRS0=") {
+		return "", errors.New("Unsupported SRS address")
+	}
+
+	// SRS0=hash=timestamp=host=local
+	parts := strings.SplitN(local[5:], "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", errors.New("Invalid SRS address")
+	}
+
+	if !strings.EqualFold(parts[0], s.hash(parts[1], parts[2], parts[3])) {
+		return "", errors.New("Invalid SRS hash")
+	}
+
+	age, err := srsTimestampAge(parts[1], time.Now())
+	if err != nil {
+		return "", err
+	}
+	if s.MaxAge > 0 && age > s.MaxAge {
+		return "", errors.New("Expired SRS address")
+	}
+
+	return parts[3] + "@" + parts[2], nil
+}
+
+func (s *SRS) hash(timestamp, host, local string) string {
+	mac := hmac.New(sha1.New, s.Secret)
+	mac.Write([]byte(strings.ToLower(timestamp + host + local)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+// srsTimestamp encodes the current day as two base32 characters
+func srsTimestamp(now time.Time) string {
+	day := int(now.Unix()/86400) % srsTimestampCycle
+	return string([]byte{
+		srsTimestampAlphabet[day>>5],
+		srsTimestampAlphabet[day&31],
+	})
+}
+
+// srsTimestampAge returns how many days ago a timestamp was generated
+func srsTimestampAge(timestamp string, now time.Time) (int, error) {
+	if len(timestamp) != 2 {
+		return 0, errors.New("Invalid SRS timestamp")
+	}
+
+	day := 0
+	for _, c := range strings.ToUpper(timestamp) {
+		index := strings.IndexRune(srsTimestampAlphabet, c)
+		if index == -1 {
+			return 0, errors.New("Invalid SRS timestamp")
+		}
+		day = day<<5 | index
+	}
+
+	today := int(now.Unix()/86400) % srsTimestampCycle
+	return (today - day + srsTimestampCycle) % srsTimestampCycle, nil
+}
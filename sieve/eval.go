@@ -0,0 +1,374 @@
+package sieve
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alexcesaro/quotedprintable"
+)
+
+// Message is the data available to the tests of a script
+type Message struct {
+	Header mail.Header
+	From   string   // Envelope sender
+	To     []string // Envelope recipients
+	Size   int
+}
+
+// Result lists the actions that a script took on a message
+type Result struct {
+	Keep   bool
+	Labels []string
+	Flags  []string
+}
+
+// Discarded tells whether the message should not be delivered at all
+func (r *Result) Discarded() bool {
+	return !r.Keep && len(r.Labels) == 0
+}
+
+// Read tells whether the message was flagged as seen
+func (r *Result) Read() bool {
+	for _, flag := range r.Flags {
+		if strings.EqualFold(flag, "\\Seen") {
+			return true
+		}
+	}
+	return false
+}
+
+type state struct {
+	message      *Message
+	implicitKeep bool
+	explicitKeep bool
+	labels       []string
+	flags        []string
+}
+
+// Evaluate runs the script against a message
+func (s *Script) Evaluate(message *Message) *Result {
+	st := &state{
+		message:      message,
+		implicitKeep: true,
+	}
+
+	st.run(s.Commands)
+
+	return &Result{
+		Keep:   st.implicitKeep || st.explicitKeep,
+		Labels: st.labels,
+		Flags:  st.flags,
+	}
+}
+
+// run executes a list of commands, returning true if the script was stopped
+func (st *state) run(commands []*Command) bool {
+	// Whether a branch of the current if chain has already been taken
+	taken := false
+
+	for _, command := range commands {
+		switch command.Name {
+		case "if", "elsif", "else":
+			if command.Name == "if" {
+				taken = false
+			}
+			if taken {
+				continue
+			}
+			if command.Name != "else" && !st.test(command.Tests[0]) {
+				continue
+			}
+
+			taken = true
+			if st.run(command.Block) {
+				return true
+			}
+		case "keep":
+			st.explicitKeep = true
+		case "discard":
+			st.implicitKeep = false
+		case "fileinto":
+			label := command.Arguments[0].Strings[0]
+			if !contains(st.labels, label) {
+				st.labels = append(st.labels, label)
+			}
+			st.implicitKeep = false
+		case "addflag":
+			for _, flag := range command.Arguments[0].Strings {
+				for _, name := range strings.Fields(flag) {
+					if !contains(st.flags, name) {
+						st.flags = append(st.flags, name)
+					}
+				}
+			}
+		case "setflag":
+			st.flags = []string{}
+			for _, flag := range command.Arguments[0].Strings {
+				st.flags = append(st.flags, strings.Fields(flag)...)
+			}
+		case "stop":
+			return true
+		}
+	}
+
+	return false
+}
+
+func (st *state) test(test *Test) bool {
+	switch test.Name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !st.test(test.Tests[0])
+	case "allof":
+		for _, child := range test.Tests {
+			if !st.test(child) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, child := range test.Tests {
+			if st.test(child) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range test.Arguments[0].Strings {
+			if len(st.message.Header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+				return false
+			}
+		}
+		return true
+	case "size":
+		if test.Arguments[0].Tag == "over" {
+			return int64(st.message.Size) > test.Arguments[1].Number
+		}
+		return int64(st.message.Size) < test.Arguments[1].Number
+	case "header":
+		options, positional, _ := parseMatchArguments(test)
+		for _, name := range positional[0] {
+			for _, value := range st.message.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+				if options.matchAny(decodeHeader(value), positional[1]) {
+					return true
+				}
+			}
+		}
+		return false
+	case "address":
+		options, positional, _ := parseMatchArguments(test)
+		for _, name := range positional[0] {
+			for _, value := range st.message.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+				addresses, err := mail.ParseAddressList(value)
+				if err != nil {
+					continue
+				}
+				for _, address := range addresses {
+					if options.matchAny(options.addressPart(address.Address), positional[1]) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	case "envelope":
+		options, positional, _ := parseMatchArguments(test)
+		for _, part := range positional[0] {
+			addresses := st.message.To
+			if part == "from" {
+				addresses = []string{st.message.From}
+			}
+			for _, address := range addresses {
+				if options.matchAny(options.addressPart(address), positional[1]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+type matchOptions struct {
+	MatchType   string
+	Comparator  string
+	AddressPart string
+}
+
+// parseMatchArguments splits the arguments of header, address and envelope
+// tests into tagged options and positional string lists.
+func parseMatchArguments(test *Test) (*matchOptions, [][]string, error) {
+	options := &matchOptions{
+		MatchType:   "is",
+		Comparator:  "i;ascii-casemap",
+		AddressPart: "all",
+	}
+	positional := [][]string{}
+
+	var (
+		matchSet bool
+		partSet  bool
+	)
+	for i := 0; i < len(test.Arguments); i++ {
+		argument := test.Arguments[i]
+
+		switch argument.Type {
+		case ArgumentStrings:
+			positional = append(positional, argument.Strings)
+			continue
+		case ArgumentNumber:
+			return nil, nil, fmt.Errorf("Line %d: Unexpected number in %s", test.Line, test.Name)
+		}
+
+		switch argument.Tag {
+		case "is", "contains", "matches":
+			if matchSet {
+				return nil, nil, fmt.Errorf("Line %d: Duplicate match type", test.Line)
+			}
+			matchSet = true
+			options.MatchType = argument.Tag
+		case "all", "localpart", "domain":
+			if test.Name == "header" || partSet {
+				return nil, nil, fmt.Errorf("Line %d: Unexpected address part :%s", test.Line, argument.Tag)
+			}
+			partSet = true
+			options.AddressPart = argument.Tag
+		case "comparator":
+			if i+1 >= len(test.Arguments) || test.Arguments[i+1].Type != ArgumentStrings ||
+				len(test.Arguments[i+1].Strings) != 1 {
+				return nil, nil, fmt.Errorf("Line %d: :comparator expects a comparator name", test.Line)
+			}
+			i++
+			options.Comparator = test.Arguments[i].Strings[0]
+			if options.Comparator != "i;octet" && options.Comparator != "i;ascii-casemap" {
+				return nil, nil, fmt.Errorf("Line %d: Unsupported comparator \"%s\"", test.Line, options.Comparator)
+			}
+		default:
+			return nil, nil, fmt.Errorf("Line %d: Unsupported tag :%s", test.Line, argument.Tag)
+		}
+	}
+
+	return options, positional, nil
+}
+
+func (o *matchOptions) addressPart(address string) string {
+	switch o.AddressPart {
+	case "localpart":
+		if i := strings.LastIndex(address, "@"); i != -1 {
+			return address[:i]
+		}
+		return address
+	case "domain":
+		if i := strings.LastIndex(address, "@"); i != -1 {
+			return address[i+1:]
+		}
+		return ""
+	}
+
+	return address
+}
+
+func (o *matchOptions) matchAny(value string, keys []string) bool {
+	for _, key := range keys {
+		if o.match(value, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *matchOptions) match(value, key string) bool {
+	if o.Comparator == "i;ascii-casemap" {
+		value = strings.ToLower(value)
+		key = strings.ToLower(key)
+	}
+
+	switch o.MatchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return wildcardMatch(value, key)
+	}
+
+	return value == key
+}
+
+// wildcardMatch implements the :matches match type, where "*" matches any
+// sequence, "?" matches a single character and "\" escapes the next one.
+// Only the last "*" is ever backtracked to, so matching takes at most
+// len(value) * len(pattern) steps.
+func wildcardMatch(value, pattern string) bool {
+	var (
+		v, p int
+
+		// Position after the last "*" and the value's position it matched up to
+		star      = -1
+		starValue = 0
+	)
+
+	for v < len(value) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				p++
+				star = p
+				starValue = v
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(value[v:])
+				v += size
+				p++
+				continue
+			default:
+				c, n := pattern[p], 1
+				if c == '\\' && p+1 < len(pattern) {
+					c, n = pattern[p+1], 2
+				}
+				if value[v] == c {
+					v++
+					p += n
+					continue
+				}
+			}
+		}
+
+		// Let the last "*" consume one more byte
+		if star == -1 {
+			return false
+		}
+		starValue++
+		v = starValue
+		p = star
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+func decodeHeader(value string) string {
+	if len(value) > 1 && value[0] == '=' && value[1] == '?' {
+		if decoded, _, err := quotedprintable.DecodeHeader(value); err == nil {
+			return decoded
+		}
+	}
+	return value
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package sieve
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessage() *Message {
+	return &Message{
+		Header: mail.Header{
+			"From":    []string{"Alice Example <alice@Example.com>"},
+			"To":      []string{"bob@lavaboom.com, carol@lavaboom.com"},
+			"Subject": []string{"=?utf-8?q?Weekly_report?="},
+			"List-Id": []string{"<golang-nuts.googlegroups.com>"},
+		},
+		From: "bounces@lists.example.com",
+		To:   []string{"bob@lavaboom.com"},
+		Size: 2048,
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   Result
+	}{
+		{
+			name:   "empty script keeps",
+			script: ``,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "header :is is case-insensitive by default",
+			script: `require "fileinto"; if header :is "subject" "WEEKLY REPORT" { fileinto "Reports"; }`,
+			want:   Result{Labels: []string{"Reports"}},
+		},
+		{
+			name:   "header :is with i;octet",
+			script: `require "fileinto"; if header :is :comparator "i;octet" "Subject" "weekly report" { fileinto "Reports"; }`,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "header :contains",
+			script: `require "fileinto"; if header :contains "List-Id" "golang-nuts" { fileinto "Go"; }`,
+			want:   Result{Labels: []string{"Go"}},
+		},
+		{
+			name:   "header :matches",
+			script: `require "fileinto"; if header :matches "Subject" "W?ekly*" { fileinto "Reports"; }`,
+			want:   Result{Labels: []string{"Reports"}},
+		},
+		{
+			name:   "header :matches has to match the whole value",
+			script: `require "fileinto"; if header :matches "Subject" "Weekly" { fileinto "Reports"; }`,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "address :domain",
+			script: `require "fileinto"; if address :domain "From" "example.com" { fileinto "Example"; }`,
+			want:   Result{Labels: []string{"Example"}},
+		},
+		{
+			name:   "address :localpart in a list",
+			script: `require "fileinto"; if address :localpart :is "To" "carol" { fileinto "Carol"; }`,
+			want:   Result{Labels: []string{"Carol"}},
+		},
+		{
+			name:   "envelope from",
+			script: `require ["envelope", "fileinto"]; if envelope :matches "from" "*@lists.example.com" { fileinto "Lists"; }`,
+			want:   Result{Labels: []string{"Lists"}},
+		},
+		{
+			name:   "envelope to",
+			script: `require "envelope"; if envelope :is "to" "carol@lavaboom.com" { discard; }`,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "exists",
+			script: `if exists ["List-Id", "From"] { discard; }`,
+			want:   Result{},
+		},
+		{
+			name:   "exists requires all headers",
+			script: `if exists ["List-Id", "X-Spam"] { discard; }`,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "size :over",
+			script: `if size :over 1K { discard; }`,
+			want:   Result{},
+		},
+		{
+			name:   "size :under",
+			script: `if size :under 1K { discard; }`,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "allof",
+			script: `if allof (size :over 1K, header :contains "Subject" "report") { discard; }`,
+			want:   Result{},
+		},
+		{
+			name:   "allof fails on a single test",
+			script: `if allof (size :over 1K, header :contains "Subject" "invoice") { discard; }`,
+			want:   Result{Keep: true},
+		},
+		{
+			name:   "anyof",
+			script: `if anyof (size :over 1M, header :contains "Subject" "report") { discard; }`,
+			want:   Result{},
+		},
+		{
+			name:   "not",
+			script: `if not exists "X-Spam" { discard; }`,
+			want:   Result{},
+		},
+		{
+			name:   "elsif and else",
+			script: `require "fileinto"; if false { fileinto "A"; } elsif false { fileinto "B"; } else { fileinto "C"; }`,
+			want:   Result{Labels: []string{"C"}},
+		},
+		{
+			name:   "only the first matching branch runs",
+			script: `require "fileinto"; if true { fileinto "A"; } elsif true { fileinto "B"; }`,
+			want:   Result{Labels: []string{"A"}},
+		},
+		{
+			name:   "fileinto and keep",
+			script: `require "fileinto"; fileinto "A"; fileinto "A"; keep;`,
+			want:   Result{Keep: true, Labels: []string{"A"}},
+		},
+		{
+			name:   "fileinto after discard",
+			script: `require "fileinto"; discard; fileinto "A";`,
+			want:   Result{Labels: []string{"A"}},
+		},
+		{
+			name:   "flags",
+			script: `require "imap4flags"; addflag "\\Seen \\Flagged"; addflag "\\Seen";`,
+			want:   Result{Keep: true, Flags: []string{"\\Seen", "\\Flagged"}},
+		},
+		{
+			name:   "setflag replaces flags",
+			script: `require "imap4flags"; addflag "\\Flagged"; setflag "\\Seen";`,
+			want:   Result{Keep: true, Flags: []string{"\\Seen"}},
+		},
+		{
+			name:   "stop",
+			script: `require "fileinto"; fileinto "A"; stop; fileinto "B";`,
+			want:   Result{Labels: []string{"A"}},
+		},
+		{
+			name:   "stop in a nested block",
+			script: `require "fileinto"; if true { if true { stop; } } fileinto "B";`,
+			want:   Result{Keep: true},
+		},
+	}
+
+	for _, test := range tests {
+		script, err := Parse(test.script)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := script.Evaluate(testMessage())
+		if got.Keep != test.want.Keep ||
+			!reflect.DeepEqual(nonNil(got.Labels), nonNil(test.want.Labels)) ||
+			!reflect.DeepEqual(nonNil(got.Flags), nonNil(test.want.Flags)) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
+
+func TestResult(t *testing.T) {
+	if !(&Result{}).Discarded() {
+		t.Error("Result without keep and labels should be discarded")
+	}
+	if (&Result{Labels: []string{"A"}}).Discarded() {
+		t.Error("Result with a label shouldn't be discarded")
+	}
+	if !(&Result{Flags: []string{"\\seen"}}).Read() {
+		t.Error("\\seen flag should mark the message as read")
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		value   string
+		pattern string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "*", true},
+		{"", "?", false},
+		{"abc", "abc", true},
+		{"abc", "ab", false},
+		{"abc", "a*", true},
+		{"abc", "*c", true},
+		{"abc", "*b*", true},
+		{"abc", "a?c", true},
+		{"abc", "a??c", false},
+		{"aXbXc", "a*b*c", true},
+		{"abcbd", "*b?", true},
+		{"mississippi", "m*iss*ppi", true},
+		{"mississippi", "m*iss*pi?", false},
+		{"żółw", "???w", true},
+		{"żółw", "?*?", true},
+		{"a*c", "a\\*c", true},
+		{"abc", "a\\*c", false},
+		{"a?", "a\\?", true},
+		{"a\\", "a\\", true},
+	}
+
+	for _, test := range tests {
+		if got := wildcardMatch(test.value, test.pattern); got != test.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", test.value, test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestWildcardMatchBacktracking(t *testing.T) {
+	value := strings.Repeat("a", 10000)
+	pattern := strings.Repeat("*a", 20) + "b"
+
+	start := time.Now()
+	if wildcardMatch(value, pattern) {
+		t.Error("Pattern shouldn't match")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Matching took %s", elapsed)
+	}
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
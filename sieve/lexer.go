@@ -0,0 +1,192 @@
+package sieve
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	Type   tokenType
+	Value  string
+	Number int64
+	Line   int
+}
+
+// lex splits a Sieve script into tokens as defined in RFC 5228, section 8.1
+func lex(input string) ([]token, error) {
+	var (
+		tokens = []token{}
+		line   = 1
+		i      = 0
+	)
+
+	for i < len(input) {
+		c := input[i]
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			// Hash comments run until the end of the line
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(input) && input[i+1] == '*':
+			end := strings.Index(input[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("Line %d: Unterminated comment", line)
+			}
+			line += strings.Count(input[i:i+2+end], "\n")
+			i += end + 4
+		case strings.IndexByte("[](){},;", c) != -1:
+			tokens = append(tokens, token{Type: tokenSymbol, Value: string(c), Line: line})
+			i++
+		case c == '"':
+			value := []byte{}
+			start := line
+			i++
+			for {
+				if i >= len(input) {
+					return nil, fmt.Errorf("Line %d: Unterminated string", start)
+				}
+				if input[i] == '"' {
+					i++
+					break
+				}
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+				}
+				if input[i] == '\n' {
+					line++
+				}
+				value = append(value, input[i])
+				i++
+			}
+			tokens = append(tokens, token{Type: tokenString, Value: string(value), Line: start})
+		case c == ':':
+			j := i + 1
+			for j < len(input) && isIdentifierChar(input[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("Line %d: Empty tag", line)
+			}
+			tokens = append(tokens, token{Type: tokenTag, Value: strings.ToLower(input[i+1 : j]), Line: line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(input) && input[j] >= '0' && input[j] <= '9' {
+				j++
+			}
+			number, err := strconv.ParseInt(input[i:j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %s", line, err)
+			}
+			if j < len(input) {
+				shift := uint(0)
+				switch input[j] {
+				case 'K', 'k':
+					shift = 10
+				case 'M', 'm':
+					shift = 20
+				case 'G', 'g':
+					shift = 30
+				}
+				if shift > 0 {
+					if number > math.MaxInt64>>shift {
+						return nil, fmt.Errorf("Line %d: Number is too large", line)
+					}
+					number <<= shift
+					j++
+				}
+			}
+			tokens = append(tokens, token{Type: tokenNumber, Number: number, Line: line})
+			i = j
+		case isIdentifierChar(c):
+			j := i
+			for j < len(input) && isIdentifierChar(input[j]) {
+				j++
+			}
+			identifier := strings.ToLower(input[i:j])
+			i = j
+
+			// Multi-line strings start with "text:"
+			if identifier == "text" && i < len(input) && input[i] == ':' {
+				value, n, lines, err := lexMultiline(input[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("Line %d: %s", line, err)
+				}
+				tokens = append(tokens, token{Type: tokenString, Value: value, Line: line})
+				line += lines
+				i += n + 1
+				continue
+			}
+
+			tokens = append(tokens, token{Type: tokenIdentifier, Value: identifier, Line: line})
+		default:
+			return nil, fmt.Errorf("Line %d: Unexpected character %q", line, c)
+		}
+	}
+
+	tokens = append(tokens, token{Type: tokenEOF, Line: line})
+	return tokens, nil
+}
+
+// lexMultiline reads a multi-line string terminated by a line with a single
+// dot. Returns the string, number of consumed bytes and lines.
+func lexMultiline(input string) (string, int, int, error) {
+	// The rest of the "text:" line is ignored
+	start := strings.IndexByte(input, '\n')
+	if start == -1 {
+		return "", 0, 0, fmt.Errorf("Unterminated multi-line string")
+	}
+
+	var (
+		lines  = []string{}
+		offset = start + 1
+		count  = 1
+	)
+	for {
+		end := strings.IndexByte(input[offset:], '\n')
+		if end == -1 {
+			return "", 0, 0, fmt.Errorf("Unterminated multi-line string")
+		}
+
+		current := strings.TrimRight(input[offset:offset+end], "\r")
+		offset += end + 1
+		count++
+
+		if current == "." {
+			break
+		}
+
+		// Remove dot-stuffing
+		if strings.HasPrefix(current, "..") {
+			current = current[1:]
+		}
+
+		lines = append(lines, current)
+	}
+
+	return strings.Join(lines, "\n"), offset, count, nil
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,306 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+// Maximal depth of nested blocks and tests. Parsing, validation and
+// evaluation are recursive, so deeper scripts could exhaust the stack.
+const maxNesting = 32
+
+// Argument types
+const (
+	ArgumentTag = iota
+	ArgumentStrings
+	ArgumentNumber
+)
+
+// Argument is a single positional or tagged argument of a command or a test
+type Argument struct {
+	Type    int
+	Tag     string
+	Strings []string
+	Number  int64
+}
+
+// Test is a condition used by control commands
+type Test struct {
+	Name      string
+	Arguments []Argument
+	Tests     []*Test
+	Line      int
+}
+
+// Command is a single statement of a script
+type Command struct {
+	Name      string
+	Arguments []Argument
+	Tests     []*Test
+	Block     []*Command
+	Line      int
+}
+
+// Script is a parsed and validated Sieve script
+type Script struct {
+	Commands []*Command
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// Parse parses a script and checks that it only uses the supported subset
+// of Sieve.
+func Parse(input string) (*Script, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Type != tokenEOF {
+		return nil, fmt.Errorf("Line %d: Unexpected %s", tok.Line, describeToken(tok))
+	}
+
+	if err := validate(commands); err != nil {
+		return nil, err
+	}
+
+	return &Script{Commands: commands}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.Type != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	tok := p.peek()
+	return tok.Type == tokenSymbol && tok.Value == symbol
+}
+
+// enter descends into a nested block or test
+func (p *parser) enter(line int) error {
+	p.depth++
+	if p.depth > maxNesting {
+		return fmt.Errorf("Line %d: Nesting is deeper than %d levels", line, maxNesting)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) expect(symbol string) error {
+	tok := p.next()
+	if tok.Type != tokenSymbol || tok.Value != symbol {
+		return fmt.Errorf("Line %d: Expected \"%s\", got %s", tok.Line, symbol, describeToken(tok))
+	}
+	return nil
+}
+
+// commands := *command
+func (p *parser) commands() ([]*Command, error) {
+	commands := []*Command{}
+
+	for p.peek().Type == tokenIdentifier {
+		command, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+
+	return commands, nil
+}
+
+// command := identifier arguments (";" / block)
+func (p *parser) command() (*Command, error) {
+	tok := p.next()
+	command := &Command{
+		Name: tok.Value,
+		Line: tok.Line,
+	}
+
+	arguments, tests, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	command.Arguments = arguments
+	command.Tests = tests
+
+	if p.isSymbol("{") {
+		p.next()
+
+		if err := p.enter(tok.Line); err != nil {
+			return nil, err
+		}
+		block, err := p.commands()
+		if err != nil {
+			return nil, err
+		}
+		p.leave()
+		command.Block = block
+
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+
+		return command, nil
+	}
+
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+
+	return command, nil
+}
+
+// arguments := *argument [test / test-list]
+func (p *parser) arguments() ([]Argument, []*Test, error) {
+	arguments := []Argument{}
+
+	for {
+		tok := p.peek()
+
+		switch {
+		case tok.Type == tokenTag:
+			p.next()
+			arguments = append(arguments, Argument{Type: ArgumentTag, Tag: tok.Value})
+		case tok.Type == tokenNumber:
+			p.next()
+			arguments = append(arguments, Argument{Type: ArgumentNumber, Number: tok.Number})
+		case tok.Type == tokenString || p.isSymbol("["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			arguments = append(arguments, Argument{Type: ArgumentStrings, Strings: list})
+		case tok.Type == tokenIdentifier:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return arguments, []*Test{test}, nil
+		case p.isSymbol("("):
+			tests, err := p.testList()
+			if err != nil {
+				return nil, nil, err
+			}
+			return arguments, tests, nil
+		default:
+			return arguments, nil, nil
+		}
+	}
+}
+
+// string-list := "[" string *("," string) "]" / string
+func (p *parser) stringList() ([]string, error) {
+	if !p.isSymbol("[") {
+		return []string{p.next().Value}, nil
+	}
+	p.next()
+
+	list := []string{}
+	for {
+		tok := p.next()
+		if tok.Type != tokenString {
+			return nil, fmt.Errorf("Line %d: Expected a string, got %s", tok.Line, describeToken(tok))
+		}
+		list = append(list, tok.Value)
+
+		if p.isSymbol(",") {
+			p.next()
+			continue
+		}
+
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+
+		return list, nil
+	}
+}
+
+// test := identifier arguments
+func (p *parser) test() (*Test, error) {
+	tok := p.next()
+	if tok.Type != tokenIdentifier {
+		return nil, fmt.Errorf("Line %d: Expected a test, got %s", tok.Line, describeToken(tok))
+	}
+
+	if err := p.enter(tok.Line); err != nil {
+		return nil, err
+	}
+	arguments, tests, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	p.leave()
+
+	return &Test{
+		Name:      tok.Value,
+		Arguments: arguments,
+		Tests:     tests,
+		Line:      tok.Line,
+	}, nil
+}
+
+// test-list := "(" test *("," test) ")"
+func (p *parser) testList() ([]*Test, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	tests := []*Test{}
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+
+		if p.isSymbol(",") {
+			p.next()
+			continue
+		}
+
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		return tests, nil
+	}
+}
+
+func describeToken(tok token) string {
+	switch tok.Type {
+	case tokenEOF:
+		return "end of script"
+	case tokenIdentifier:
+		return "identifier \"" + tok.Value + "\""
+	case tokenTag:
+		return "tag \":" + tok.Value + "\""
+	case tokenString:
+		return "string"
+	case tokenNumber:
+		return "number"
+	}
+
+	return "\"" + tok.Value + "\""
+}
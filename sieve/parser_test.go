@@ -0,0 +1,146 @@
+package sieve
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	script, err := Parse(`# Sort mailing lists
+require ["fileinto", "imap4flags"];
+
+/* Lists get their own labels */
+if allof (header :contains "List-Id" "golang", not size :over 100K) {
+	fileinto "Go";
+	addflag ["\\Seen", "Lists"];
+	stop;
+} elsif address :domain :is ["from", "sender"] "example.com" {
+	fileinto "Example";
+} else {
+	keep;
+}
+
+if header :matches "Subject" text:
+*[SPAM]*
+.
+{
+	discard;
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(script.Commands) != 5 {
+		t.Fatalf("Expected 5 commands, got %d", len(script.Commands))
+	}
+
+	names := []string{}
+	for _, command := range script.Commands {
+		names = append(names, command.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"require", "if", "elsif", "else", "if"}) {
+		t.Errorf("Unexpected commands %v", names)
+	}
+
+	require := script.Commands[0]
+	if !reflect.DeepEqual(require.Arguments, []Argument{{Type: ArgumentStrings, Strings: []string{"fileinto", "imap4flags"}}}) {
+		t.Errorf("Unexpected require arguments %+v", require.Arguments)
+	}
+
+	// allof (header ..., not size ...)
+	allof := script.Commands[1].Tests[0]
+	if allof.Name != "allof" || len(allof.Tests) != 2 {
+		t.Fatalf("Unexpected test %+v", allof)
+	}
+	if header := allof.Tests[0]; header.Name != "header" || !reflect.DeepEqual(header.Arguments, []Argument{
+		{Type: ArgumentTag, Tag: "contains"},
+		{Type: ArgumentStrings, Strings: []string{"List-Id"}},
+		{Type: ArgumentStrings, Strings: []string{"golang"}},
+	}) {
+		t.Errorf("Unexpected header test %+v", header)
+	}
+	if not := allof.Tests[1]; not.Name != "not" || len(not.Tests) != 1 || !reflect.DeepEqual(not.Tests[0].Arguments, []Argument{
+		{Type: ArgumentTag, Tag: "over"},
+		{Type: ArgumentNumber, Number: 100 << 10},
+	}) {
+		t.Errorf("Unexpected not test %+v", not)
+	}
+
+	block := script.Commands[1].Block
+	if len(block) != 3 || block[0].Name != "fileinto" || block[1].Name != "addflag" || block[2].Name != "stop" {
+		t.Errorf("Unexpected block %+v", block)
+	}
+	if flags := block[1].Arguments[0].Strings; !reflect.DeepEqual(flags, []string{"\\Seen", "Lists"}) {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+
+	// Multi-line strings
+	if key := script.Commands[4].Tests[0].Arguments[2].Strings[0]; key != "*[SPAM]*" {
+		t.Errorf("Unexpected multi-line string %q", key)
+	}
+
+	// Lines are counted through comments and multi-line strings
+	if line := script.Commands[4].Block[0].Line; line != 19 {
+		t.Errorf("Expected discard on line 19, got %d", line)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{`keep`, `Expected ";"`},
+		{`if true { keep; `, `Expected "}"`},
+		{`if true keep;`, `expects a single test and a block`},
+		{`elsif true { keep; }`, `elsif without a preceding if`},
+		{`keep; else { keep; }`, `else without a preceding if`},
+		{`if true { require "fileinto"; }`, `only allowed at the top level`},
+		{`keep; require "fileinto";`, `require has to precede other commands`},
+		{`require "vacation";`, `Unsupported capability "vacation"`},
+		{`fileinto "Work";`, `fileinto requires "fileinto"`},
+		{`addflag "\\Seen";`, `addflag requires "imap4flags"`},
+		{`if envelope :is "from" "a@example.com" { keep; }`, `envelope requires "envelope"`},
+		{`require "fileinto"; fileinto ["Work", "Home"];`, `fileinto expects a single label name`},
+		{`redirect "someone@example.com";`, `Unsupported command "redirect"`},
+		{`reject "No";`, `Unsupported command "reject"`},
+		{`if body :contains "x" { discard; }`, `Unsupported test "body"`},
+		{`if header :regex "Subject" "x" { discard; }`, `Unsupported tag :regex`},
+		{`if header :is :contains "Subject" "x" { discard; }`, `Duplicate match type`},
+		{`if header :domain "From" "x" { discard; }`, `Unexpected address part :domain`},
+		{`if header :comparator "i;unicode" "Subject" "x" { discard; }`, `Unsupported comparator`},
+		{`if size 100 { discard; }`, `size expects :over or :under and a number`},
+		{`if size :over 9999999999G { discard; }`, `Number is too large`},
+		{`if size :over 99999999999999999999 { discard; }`, `out of range`},
+		{`if not (true, false) { discard; }`, `not expects a single test`},
+		{`if allof () { discard; }`, `Expected a test`},
+		{`keep; "string";`, `Unexpected string`},
+		{`if header "Subject" "x { discard; }`, `Unterminated string`},
+		{`/* keep;`, `Unterminated comment`},
+		{"if header \"Subject\" text:\nx\n", `Unterminated multi-line string`},
+		{`keep; @`, `Unexpected character`},
+		{strings.Repeat("if true {", maxNesting+1) + strings.Repeat("}", maxNesting+1), `Nesting is deeper than`},
+		{"if " + strings.Repeat("not ", 100000) + "true { discard; }", `Nesting is deeper than`},
+		{"if " + strings.Repeat("anyof (", 100000) + "true" + strings.Repeat(")", 100000) + " { discard; }", `Nesting is deeper than`},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.script)
+		if err == nil {
+			t.Errorf("%.80q: Expected an error", test.script)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%.80q: Expected an error containing %q, got %q", test.script, test.err, err.Error())
+		}
+	}
+}
+
+func TestParseNesting(t *testing.T) {
+	script := strings.Repeat("if true {", maxNesting) + strings.Repeat("}", maxNesting)
+	if _, err := Parse(script); err != nil {
+		t.Errorf("Expected %d nested blocks to parse, got %s", maxNesting, err)
+	}
+}
@@ -0,0 +1,175 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+// Capabilities lists the extensions that can be required by scripts
+var Capabilities = []string{
+	"fileinto",
+	"envelope",
+	"imap4flags",
+	"comparator-i;octet",
+	"comparator-i;ascii-casemap",
+}
+
+// validate checks the script's commands. Extensions have to be required at
+// the beginning of the script before they're used.
+func validate(commands []*Command) error {
+	required := map[string]struct{}{}
+	for i, command := range commands {
+		if command.Name != "require" {
+			continue
+		}
+		if i > 0 && commands[i-1].Name != "require" {
+			return fmt.Errorf("Line %d: require has to precede other commands", command.Line)
+		}
+		if len(command.Arguments) != 1 || command.Arguments[0].Type != ArgumentStrings ||
+			len(command.Tests) > 0 || command.Block != nil {
+			return fmt.Errorf("Line %d: require expects a list of capabilities", command.Line)
+		}
+		for _, capability := range command.Arguments[0].Strings {
+			if !isCapability(capability) {
+				return fmt.Errorf("Line %d: Unsupported capability \"%s\"", command.Line, capability)
+			}
+			required[capability] = struct{}{}
+		}
+	}
+
+	return validateCommands(commands, required, true)
+}
+
+func validateCommands(commands []*Command, required map[string]struct{}, topLevel bool) error {
+	for i, command := range commands {
+		switch command.Name {
+		case "require":
+			if !topLevel {
+				return fmt.Errorf("Line %d: require is only allowed at the top level", command.Line)
+			}
+			continue
+		case "if", "elsif":
+			if command.Name == "elsif" && !followsIf(commands, i) {
+				return fmt.Errorf("Line %d: elsif without a preceding if", command.Line)
+			}
+			if len(command.Arguments) > 0 || len(command.Tests) != 1 || command.Block == nil {
+				return fmt.Errorf("Line %d: %s expects a single test and a block", command.Line, command.Name)
+			}
+			if err := validateTest(command.Tests[0], required); err != nil {
+				return err
+			}
+		case "else":
+			if !followsIf(commands, i) {
+				return fmt.Errorf("Line %d: else without a preceding if", command.Line)
+			}
+			if len(command.Arguments) > 0 || len(command.Tests) > 0 || command.Block == nil {
+				return fmt.Errorf("Line %d: else expects a block", command.Line)
+			}
+		case "keep", "discard", "stop":
+			if len(command.Arguments) > 0 || len(command.Tests) > 0 || command.Block != nil {
+				return fmt.Errorf("Line %d: %s takes no arguments", command.Line, command.Name)
+			}
+		case "fileinto":
+			if err := requireCapability(required, "fileinto", command.Name, command.Line); err != nil {
+				return err
+			}
+			if len(command.Arguments) != 1 || command.Arguments[0].Type != ArgumentStrings ||
+				len(command.Arguments[0].Strings) != 1 || len(command.Tests) > 0 || command.Block != nil {
+				return fmt.Errorf("Line %d: fileinto expects a single label name", command.Line)
+			}
+		case "addflag", "setflag":
+			if err := requireCapability(required, "imap4flags", command.Name, command.Line); err != nil {
+				return err
+			}
+			if len(command.Arguments) != 1 || command.Arguments[0].Type != ArgumentStrings ||
+				len(command.Tests) > 0 || command.Block != nil {
+				return fmt.Errorf("Line %d: %s expects a list of flags", command.Line, command.Name)
+			}
+		default:
+			return fmt.Errorf("Line %d: Unsupported command \"%s\"", command.Line, command.Name)
+		}
+
+		if command.Block != nil {
+			if err := validateCommands(command.Block, required, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateTest(test *Test, required map[string]struct{}) error {
+	switch test.Name {
+	case "header", "address", "envelope":
+		_, positional, err := parseMatchArguments(test)
+		if err != nil {
+			return err
+		}
+		if len(positional) != 2 || len(test.Tests) > 0 {
+			return fmt.Errorf("Line %d: %s expects a list of names and a list of keys", test.Line, test.Name)
+		}
+		if test.Name == "envelope" {
+			if err := requireCapability(required, "envelope", test.Name, test.Line); err != nil {
+				return err
+			}
+			for _, part := range positional[0] {
+				if part != "from" && part != "to" {
+					return fmt.Errorf("Line %d: Unsupported envelope part \"%s\"", test.Line, part)
+				}
+			}
+		}
+	case "exists":
+		if len(test.Arguments) != 1 || test.Arguments[0].Type != ArgumentStrings || len(test.Tests) > 0 {
+			return fmt.Errorf("Line %d: exists expects a list of header names", test.Line)
+		}
+	case "size":
+		if len(test.Arguments) != 2 || test.Arguments[0].Type != ArgumentTag ||
+			(test.Arguments[0].Tag != "over" && test.Arguments[0].Tag != "under") ||
+			test.Arguments[1].Type != ArgumentNumber || len(test.Tests) > 0 {
+			return fmt.Errorf("Line %d: size expects :over or :under and a number", test.Line)
+		}
+	case "allof", "anyof":
+		if len(test.Arguments) > 0 || len(test.Tests) == 0 {
+			return fmt.Errorf("Line %d: %s expects a list of tests", test.Line, test.Name)
+		}
+		for _, child := range test.Tests {
+			if err := validateTest(child, required); err != nil {
+				return err
+			}
+		}
+	case "not":
+		if len(test.Arguments) > 0 || len(test.Tests) != 1 {
+			return fmt.Errorf("Line %d: not expects a single test", test.Line)
+		}
+		return validateTest(test.Tests[0], required)
+	case "true", "false":
+		if len(test.Arguments) > 0 || len(test.Tests) > 0 {
+			return fmt.Errorf("Line %d: %s takes no arguments", test.Line, test.Name)
+		}
+	default:
+		return fmt.Errorf("Line %d: Unsupported test \"%s\"", test.Line, test.Name)
+	}
+
+	return nil
+}
+
+func followsIf(commands []*Command, i int) bool {
+	return i > 0 && (commands[i-1].Name == "if" || commands[i-1].Name == "elsif")
+}
+
+// requireCapability checks that a command or a test's extension was required
+func requireCapability(required map[string]struct{}, capability string, name string, line int) error {
+	if _, ok := required[capability]; !ok {
+		return fmt.Errorf("Line %d: %s requires \"%s\"", line, name, capability)
+	}
+	return nil
+}
+
+func isCapability(name string) bool {
+	for _, capability := range Capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
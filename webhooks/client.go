@@ -0,0 +1,119 @@
+package webhooks
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Webhook addresses are set by users, so requests mustn't reach services
+// that are only accessible from our network
+var blockedNetworks = []*net.IPNet{}
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "This" network
+		"10.0.0.0/8",     // Private
+		"100.64.0.0/10",  // Carrier-grade NAT
+		"127.0.0.0/8",    // Loopback
+		"169.254.0.0/16", // Link-local
+		"172.16.0.0/12",  // Private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // Private
+		"198.18.0.0/15",  // Benchmarking
+		"224.0.0.0/4",    // Multicast
+		"240.0.0.0/4",    // Reserved and broadcast
+		"::/128",         // Unspecified
+		"::1/128",        // Loopback
+		"fc00::/7",       // Unique local
+		"fe80::/10",      // Link-local
+		"ff00::/8",       // Multicast
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blockedNetworks = append(blockedNetworks, network)
+	}
+}
+
+var (
+	// errBlockedAddress is returned for webhooks pointing at our network
+	errBlockedAddress = errors.New("Webhook address is not publicly routable")
+
+	// errInvalidScheme is returned for addresses other than HTTP(S) URLs
+	errInvalidScheme = errors.New("Webhook address has to be an HTTP or HTTPS URL")
+)
+
+// isPublicIP checks whether the IP is outside of blocked networks
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkAddress validates the webhook's URL before sending anything
+func checkAddress(address string) error {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errInvalidScheme
+	}
+
+	return nil
+}
+
+// dialPublic connects only to public IPs. Addresses are checked after the
+// lookup, so that hostnames can't be pointed at our network either.
+func dialPublic(network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, errBlockedAddress
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+	}
+	return dialer.Dial(network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// refuseRedirects makes the client return redirects as they are, which
+// counts them as failed deliveries
+func refuseRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// newClient creates an HTTP client that can't be used to reach our network
+func newClient() *http.Client {
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Dial:                dialPublic,
+			TLSHandshakeTimeout: requestTimeout,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: refuseRedirects,
+	}
+}
@@ -0,0 +1,397 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bitly/go-nsq"
+	"github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/api/models"
+	"github.com/lavab/webhook/events"
+
+	"github.com/lavab/mailer/shared"
+)
+
+const (
+	// Number of attempts to deliver an event to a webhook
+	maxAttempts = 8
+
+	// Delay before the first retry, doubled with each attempt
+	minBackoff = 30 * time.Second
+
+	// Maximal delay between retries, limited by nsqd's max_requeue_delay
+	maxBackoff = 15 * time.Minute
+
+	// Number of consecutive failed deliveries that disables a webhook
+	maxFailures = 10
+
+	// Deadline of a single HTTP request
+	requestTimeout = 10 * time.Second
+
+	// Header carrying the HMAC-SHA256 signature of the body
+	signatureHeader = "X-Lavaboom-Signature"
+)
+
+// Dispatcher delivers events to HTTP webhooks. Deliveries are signed with
+// keys derived from the secret, which mustn't be empty.
+type Dispatcher struct {
+	Store  Store
+	Secret []byte
+	Client *http.Client
+}
+
+// StartDispatcher consumes hook_incoming events, fans them out to matching
+// webhooks and delivers them. Returned clients have to be stopped on
+// shutdown. Webhooks are disabled and nil is returned if the secret is empty.
+func StartDispatcher(config *shared.Flags) *shared.NSQClients {
+	// Initialize a new logger
+	log := logrus.New()
+	if config.LogFormatterType == "text" {
+		log.Formatter = &logrus.TextFormatter{
+			ForceColors: config.ForceColors,
+		}
+	} else if config.LogFormatterType == "json" {
+		log.Formatter = &logrus.JSONFormatter{}
+	}
+
+	log.Level = logrus.DebugLevel
+
+	// Unsigned deliveries could be forged by anyone who knows the address
+	if config.WebhookSecret == "" {
+		log.Warn("Webhook secret is not set, webhooks are disabled")
+		return nil
+	}
+
+	// Initialize the database connection
+	session, err := gorethink.Connect(gorethink.ConnectOpts{
+		Address: config.RethinkAddress,
+		AuthKey: config.RethinkKey,
+		MaxIdle: 10,
+		Timeout: time.Second * 10,
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Unable to connect to RethinkDB")
+	}
+
+	store := &RethinkStore{
+		Database: config.RethinkDatabase,
+		Session:  session,
+	}
+	store.Setup()
+
+	dispatcher := &Dispatcher{
+		Store:  store,
+		Secret: []byte(config.WebhookSecret),
+		Client: newClient(),
+	}
+
+	producer, err := nsq.NewProducer(config.NSQDAddress, nsq.NewConfig())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Unable to connect to NSQd")
+	}
+
+	// Fan incoming emails out to the account's webhooks
+	incoming, err := nsq.NewConsumer("hook_incoming", "dispatcher", nsq.NewConfig())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Unable to create a consumer")
+	}
+
+	incoming.AddConcurrentHandlers(nsq.HandlerFunc(func(msg *nsq.Message) error {
+		var event *events.Incoming
+		if err := json.Unmarshal(msg.Body, &event); err != nil || event == nil {
+			// Retrying won't fix a malformed message
+			log.WithFields(logrus.Fields{
+				"body": string(msg.Body),
+			}).Warn("Dropping an invalid incoming event")
+			return nil
+		}
+
+		deliveries, err := dispatcher.Fanout(event.Account, "incoming", msg.Body)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error":   err.Error(),
+				"account": event.Account,
+			}).Error("Unable to find webhooks")
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			body, err := json.Marshal(delivery)
+			if err != nil {
+				return err
+			}
+
+			if err := producer.Publish("hook_delivery", body); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}), 10)
+
+	// Retries are scheduled by the handler, so nsqd mustn't drop messages
+	deliveryConfig := nsq.NewConfig()
+	deliveryConfig.MaxAttempts = 0
+
+	delivery, err := nsq.NewConsumer("hook_delivery", "dispatcher", deliveryConfig)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Unable to create a consumer")
+	}
+
+	delivery.AddConcurrentHandlers(nsq.HandlerFunc(func(msg *nsq.Message) error {
+		var request *Delivery
+		if err := json.Unmarshal(msg.Body, &request); err != nil || request == nil {
+			log.WithFields(logrus.Fields{
+				"body": string(msg.Body),
+			}).Warn("Dropping an invalid webhook delivery")
+			return nil
+		}
+
+		err := dispatcher.Deliver(request, int(msg.Attempts))
+		if err == nil {
+			return nil
+		}
+
+		if msg.Attempts < maxAttempts {
+			backoff := minBackoff << uint(msg.Attempts-1)
+			if backoff > maxBackoff || backoff <= 0 {
+				backoff = maxBackoff
+			}
+
+			log.WithFields(logrus.Fields{
+				"error":    err.Error(),
+				"webhook":  request.Webhook,
+				"attempt":  msg.Attempts,
+				"retry_in": backoff.String(),
+			}).Warn("Webhook delivery failed")
+
+			msg.DisableAutoResponse()
+			msg.RequeueWithoutBackoff(backoff)
+			return nil
+		}
+
+		log.WithFields(logrus.Fields{
+			"error":   err.Error(),
+			"webhook": request.Webhook,
+		}).Warn("Giving up on a webhook delivery")
+
+		disabled, err := dispatcher.RecordFailure(request.Webhook)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error":   err.Error(),
+				"webhook": request.Webhook,
+			}).Error("Unable to record a webhook failure")
+		} else if disabled {
+			log.WithFields(logrus.Fields{
+				"webhook": request.Webhook,
+			}).Warn("Disabled a failing webhook")
+		}
+
+		return nil
+	}), 10)
+
+	for _, consumer := range []*nsq.Consumer{incoming, delivery} {
+		if err := consumer.ConnectToNSQLookupd(config.LookupdAddress); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Fatal("Unable to connect to nsqlookupd")
+		}
+	}
+
+	log.Info("Dispatching webhooks")
+
+	return &shared.NSQClients{
+		Consumers: []*nsq.Consumer{incoming, delivery},
+		Producers: []*nsq.Producer{producer},
+	}
+}
+
+// Fanout creates a delivery for every enabled webhook of the account that
+// is subscribed to the event type. Webhooks owned by other accounts are
+// skipped, as they would receive someone else's events.
+func (d *Dispatcher) Fanout(account string, kind string, data []byte) ([]*Delivery, error) {
+	webhooks, err := d.Store.FindWebhooks(account, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []*Delivery{}
+	for _, webhook := range webhooks {
+		if webhook.Owner != account {
+			continue
+		}
+
+		state, err := d.Store.GetState(webhook.ID)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil && state.Disabled {
+			continue
+		}
+
+		deliveries = append(deliveries, &Delivery{
+			ID:      uniuri.NewLen(uniuri.UUIDLen),
+			Webhook: webhook.ID,
+			Account: account,
+			Type:    kind,
+			Data:    json.RawMessage(data),
+		})
+	}
+
+	return deliveries, nil
+}
+
+// Deliver POSTs the event to the webhook's address and records the attempt.
+// Deliveries to webhooks that were removed, disabled or handed to another
+// owner in the meantime are dropped.
+func (d *Dispatcher) Deliver(delivery *Delivery, attempt int) error {
+	webhook, err := d.Store.GetWebhook(delivery.Webhook)
+	if err != nil {
+		return err
+	}
+	if webhook == nil || webhook.Owner != delivery.Account {
+		return nil
+	}
+
+	state, err := d.Store.GetState(webhook.ID)
+	if err != nil {
+		return err
+	}
+	if state != nil && state.Disabled {
+		return nil
+	}
+
+	body, err := json.Marshal(&Payload{
+		ID:   delivery.ID,
+		Type: delivery.Type,
+		Date: time.Now(),
+		Data: delivery.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	record := &Attempt{
+		Resource: models.MakeResource(webhook.Owner, "Webhook delivery"),
+		Webhook:  webhook.ID,
+		Delivery: delivery.ID,
+		Type:     delivery.Type,
+		Attempt:  attempt,
+	}
+
+	statusCode, deliveryErr := d.post(webhook, delivery, body)
+	record.StatusCode = statusCode
+	if deliveryErr != nil {
+		record.Error = deliveryErr.Error()
+	} else {
+		record.Success = true
+	}
+
+	if err := d.Store.InsertAttempt(record); err != nil {
+		return err
+	}
+
+	if deliveryErr != nil {
+		return deliveryErr
+	}
+
+	// Successful deliveries reset the failure counter. The webhook could get
+	// disabled while the request was in flight, which has to stick.
+	return d.Store.ResetFailures(webhook.ID)
+}
+
+// RecordFailure counts a delivery that failed all of its attempts and
+// disables the webhook once it fails too many times in a row. Returns true
+// if the webhook got disabled.
+func (d *Dispatcher) RecordFailure(id string) (bool, error) {
+	state, err := d.Store.GetState(id)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		state = &State{
+			ID: id,
+		}
+	}
+
+	state.Failures++
+	state.DateModified = time.Now()
+	disabled := !state.Disabled && state.Failures >= maxFailures
+	if disabled {
+		state.Disabled = true
+	}
+
+	if err := d.Store.PutState(state); err != nil {
+		return false, err
+	}
+
+	return disabled, nil
+}
+
+// post sends the body signed using HMAC-SHA256. Responses other than 2xx
+// are treated as failures.
+func (d *Dispatcher) post(webhook *models.Webhook, delivery *Delivery, body []byte) (int, error) {
+	if len(d.Secret) == 0 {
+		return 0, errors.New("Webhook secret is not set")
+	}
+
+	if err := checkAddress(webhook.Address); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", webhook.Address, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Lavaboom-Webhooks")
+	req.Header.Set("X-Lavaboom-Event", delivery.Type)
+	req.Header.Set("X-Lavaboom-Delivery", delivery.ID)
+	req.Header.Set(signatureHeader, Sign(WebhookKey(d.Secret, webhook.ID), body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// WebhookKey derives the webhook's signing key from the secret. The API
+// shows it to the webhook's owner, so that a leaked key doesn't allow
+// forging deliveries to other webhooks.
+func WebhookKey(secret []byte, id string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Sign returns the value of the signature header for the body
+func Sign(key []byte, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,451 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/lavab/api/models"
+
+	"github.com/lavab/mailer/shared"
+)
+
+// memoryStore is an in-memory Store
+type memoryStore struct {
+	lock     sync.Mutex
+	webhooks map[string]*models.Webhook
+	states   map[string]*State
+	attempts []*Attempt
+}
+
+func newMemoryStore(webhooks ...*models.Webhook) *memoryStore {
+	s := &memoryStore{
+		webhooks: map[string]*models.Webhook{},
+		states:   map[string]*State{},
+	}
+	for _, webhook := range webhooks {
+		s.webhooks[webhook.ID] = webhook
+	}
+	return s
+}
+
+func (s *memoryStore) FindWebhooks(account string, kind string) ([]*models.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	webhooks := []*models.Webhook{}
+	for _, webhook := range s.webhooks {
+		if webhook.Target == account && webhook.Type == kind {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+func (s *memoryStore) GetWebhook(id string) (*models.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.webhooks[id], nil
+}
+
+func (s *memoryStore) GetState(id string) (*State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if state, ok := s.states[id]; ok {
+		copied := *state
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) PutState(state *State) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	copied := *state
+	s.states[state.ID] = &copied
+	return nil
+}
+
+func (s *memoryStore) ResetFailures(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, ok := s.states[id]
+	if !ok {
+		state = &State{ID: id}
+		s.states[id] = state
+	}
+	state.Failures = 0
+	return nil
+}
+
+func (s *memoryStore) InsertAttempt(attempt *Attempt) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts = append(s.attempts, attempt)
+	return nil
+}
+
+func testWebhook(address string) *models.Webhook {
+	return &models.Webhook{
+		Resource: models.Resource{
+			ID:    "webhook",
+			Owner: "account",
+		},
+		Target:  "account",
+		Type:    "incoming",
+		Address: address,
+	}
+}
+
+func testDelivery() *Delivery {
+	return &Delivery{
+		ID:      "delivery",
+		Webhook: "webhook",
+		Account: "account",
+		Type:    "incoming",
+		Data:    json.RawMessage(`{"email":"id"}`),
+	}
+}
+
+func TestPostSignsDeliveries(t *testing.T) {
+	secret := []byte("secret")
+
+	var (
+		signature string
+		body      []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(signatureHeader)
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	d := &Dispatcher{
+		Secret: secret,
+		Client: server.Client(),
+	}
+
+	status, err := d.post(testWebhook(server.URL), testDelivery(), []byte(`{"id":"delivery"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", status)
+	}
+
+	if want := Sign(WebhookKey(secret, "webhook"), body); signature != want {
+		t.Errorf("Expected signature %q, got %q", want, signature)
+	}
+
+	// Keys differ between webhooks
+	if string(WebhookKey(secret, "webhook")) == string(WebhookKey(secret, "other")) {
+		t.Error("Webhooks share their signing keys")
+	}
+}
+
+func TestPostRequiresSecret(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	d := &Dispatcher{
+		Client: server.Client(),
+	}
+
+	if _, err := d.post(testWebhook(server.URL), testDelivery(), []byte(`{}`)); err == nil {
+		t.Error("Expected a delivery without a secret to fail")
+	}
+	if requests != 0 {
+		t.Errorf("Sent %d unsigned requests", requests)
+	}
+}
+
+func TestStartDispatcherRequiresSecret(t *testing.T) {
+	if clients := StartDispatcher(&shared.Flags{}); clients != nil {
+		t.Error("Dispatcher started without a secret")
+	}
+}
+
+func TestPostFailsOnErrorResponses(t *testing.T) {
+	for _, code := range []int{http.StatusMovedPermanently, http.StatusNotFound, http.StatusInternalServerError} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if code == http.StatusMovedPermanently {
+				http.Redirect(w, r, "/elsewhere", code)
+				return
+			}
+			w.WriteHeader(code)
+		}))
+
+		// Redirects are refused, so that they can't point at our network
+		client := server.Client()
+		client.CheckRedirect = refuseRedirects
+
+		d := &Dispatcher{
+			Secret: []byte("secret"),
+			Client: client,
+		}
+
+		status, err := d.post(testWebhook(server.URL), testDelivery(), []byte(`{}`))
+		if err == nil {
+			t.Errorf("%d: Expected an error", code)
+		}
+		if status != code {
+			t.Errorf("%d: Expected status %d, got %d", code, code, status)
+		}
+
+		server.Close()
+	}
+}
+
+func TestPostRejectsInvalidAddresses(t *testing.T) {
+	d := &Dispatcher{
+		Client: newClient(),
+	}
+
+	for _, address := range []string{
+		"ftp://example.com/hook",
+		"file:///etc/passwd",
+		"http://127.0.0.1/hook",
+		"http://localhost/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+	} {
+		if _, err := d.post(testWebhook(address), testDelivery(), []byte(`{}`)); err == nil {
+			t.Errorf("%s: Expected an error", address)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+
+	for _, test := range tests {
+		if got := isPublicIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestDeliverRecordsAttempts(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	store := newMemoryStore(testWebhook(server.URL))
+	store.states["webhook"] = &State{
+		ID:       "webhook",
+		Failures: 3,
+	}
+
+	d := &Dispatcher{
+		Store:  store,
+		Secret: []byte("secret"),
+		Client: server.Client(),
+	}
+
+	if err := d.Deliver(testDelivery(), 1); err == nil {
+		t.Error("Expected the first attempt to fail")
+	}
+
+	status = http.StatusNoContent
+	if err := d.Deliver(testDelivery(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(store.attempts))
+	}
+
+	failed, succeeded := store.attempts[0], store.attempts[1]
+	if failed.Success || failed.StatusCode != http.StatusServiceUnavailable || failed.Error == "" || failed.Attempt != 1 {
+		t.Errorf("Unexpected failed attempt %+v", failed)
+	}
+	if !succeeded.Success || succeeded.StatusCode != http.StatusNoContent || succeeded.Error != "" || succeeded.Attempt != 2 {
+		t.Errorf("Unexpected successful attempt %+v", succeeded)
+	}
+	for _, attempt := range store.attempts {
+		if attempt.Owner != "account" || attempt.Webhook != "webhook" || attempt.Delivery != "delivery" {
+			t.Errorf("Attempt %+v isn't linked to the delivery", attempt)
+		}
+	}
+
+	if state := store.states["webhook"]; state.Failures != 0 {
+		t.Errorf("Successful delivery didn't reset %d failures", state.Failures)
+	}
+}
+
+func TestDeliverToRemovedWebhook(t *testing.T) {
+	store := newMemoryStore()
+	d := &Dispatcher{
+		Store: store,
+	}
+
+	if err := d.Deliver(testDelivery(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.attempts) != 0 {
+		t.Errorf("Recorded %d attempts for a removed webhook", len(store.attempts))
+	}
+}
+
+func TestRecordFailureDisablesWebhook(t *testing.T) {
+	store := newMemoryStore(testWebhook("https://example.com/hook"))
+	d := &Dispatcher{
+		Store: store,
+	}
+
+	for i := 1; i <= maxFailures+1; i++ {
+		disabled, err := d.RecordFailure("webhook")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the failure that crosses the limit disables the webhook
+		if disabled != (i == maxFailures) {
+			t.Errorf("Failure %d: disabled = %v", i, disabled)
+		}
+	}
+
+	state := store.states["webhook"]
+	if !state.Disabled || state.Failures != maxFailures+1 {
+		t.Errorf("Unexpected state %+v", state)
+	}
+
+	// Disabled webhooks don't receive events
+	deliveries, err := d.Fanout("account", "incoming", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("Disabled webhook got %d deliveries", len(deliveries))
+	}
+}
+
+func TestFanoutSkipsForeignWebhooks(t *testing.T) {
+	// Someone else's webhook targeting the account
+	foreign := testWebhook("https://example.com/hook")
+	foreign.Owner = "attacker"
+
+	d := &Dispatcher{
+		Store: newMemoryStore(foreign),
+	}
+
+	deliveries, err := d.Fanout("account", "incoming", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("Foreign webhook got %d deliveries", len(deliveries))
+	}
+}
+
+func TestDeliverSkipsForeignWebhooks(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	webhook := testWebhook(server.URL)
+	webhook.Owner = "attacker"
+	store := newMemoryStore(webhook)
+
+	d := &Dispatcher{
+		Store:  store,
+		Secret: []byte("secret"),
+		Client: server.Client(),
+	}
+
+	if err := d.Deliver(testDelivery(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || len(store.attempts) != 0 {
+		t.Errorf("Delivered %d requests to a foreign webhook", requests)
+	}
+}
+
+func TestDeliverSkipsDisabledWebhooks(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	store := newMemoryStore(testWebhook(server.URL))
+	store.states["webhook"] = &State{
+		ID:       "webhook",
+		Failures: maxFailures,
+		Disabled: true,
+	}
+
+	d := &Dispatcher{
+		Store:  store,
+		Secret: []byte("secret"),
+		Client: server.Client(),
+	}
+
+	if err := d.Deliver(testDelivery(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || len(store.attempts) != 0 {
+		t.Errorf("Delivered %d requests to a disabled webhook", requests)
+	}
+}
+
+func TestLateSuccessKeepsWebhookDisabled(t *testing.T) {
+	store := newMemoryStore()
+
+	// The webhook gets disabled while the request is in flight
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.PutState(&State{
+			ID:       "webhook",
+			Failures: maxFailures,
+			Disabled: true,
+		})
+	}))
+	defer server.Close()
+	store.webhooks["webhook"] = testWebhook(server.URL)
+
+	d := &Dispatcher{
+		Store:  store,
+		Secret: []byte("secret"),
+		Client: server.Client(),
+	}
+
+	if err := d.Deliver(testDelivery(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	state := store.states["webhook"]
+	if !state.Disabled || state.Failures != 0 {
+		t.Errorf("Unexpected state %+v", state)
+	}
+}
@@ -0,0 +1,47 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/lavab/api/models"
+)
+
+// Delivery is a request to deliver an event to a single webhook, published
+// on the hook_delivery topic
+type Delivery struct {
+	ID      string          `json:"id"`
+	Webhook string          `json:"webhook"`
+	Account string          `json:"account"` // Account that the event belongs to
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Payload is the JSON body POSTed to webhook addresses
+type Payload struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Date time.Time       `json:"date"`
+	Data json.RawMessage `json:"data"`
+}
+
+// State tracks failures of a webhook. Its ID is the webhook's ID.
+type State struct {
+	ID           string    `json:"id" gorethink:"id"`
+	Failures     int       `json:"failures" gorethink:"failures"`
+	Disabled     bool      `json:"disabled" gorethink:"disabled"`
+	DateModified time.Time `json:"date_modified" gorethink:"date_modified"`
+}
+
+// Attempt is a record of a single delivery attempt
+type Attempt struct {
+	models.Resource
+
+	Webhook    string `json:"webhook" gorethink:"webhook"`
+	Delivery   string `json:"delivery" gorethink:"delivery"`
+	Type       string `json:"type" gorethink:"type"`
+	Attempt    int    `json:"attempt" gorethink:"attempt"`
+	StatusCode int    `json:"status_code,omitempty" gorethink:"status_code,omitempty"`
+	Error      string `json:"error,omitempty" gorethink:"error,omitempty"`
+	Success    bool   `json:"success" gorethink:"success"`
+}
@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"time"
+
+	"github.com/dancannon/gorethink"
+	"github.com/lavab/api/models"
+)
+
+// Store holds webhooks, their states and records of delivery attempts
+type Store interface {
+	// FindWebhooks returns webhooks owned by the account that are subscribed
+	// to the account's events of the type
+	FindWebhooks(account string, kind string) ([]*models.Webhook, error)
+
+	// GetWebhook returns the webhook or nil if it doesn't exist
+	GetWebhook(id string) (*models.Webhook, error)
+
+	// GetState returns the webhook's state or nil if it has none yet
+	GetState(id string) (*State, error)
+
+	// PutState inserts or replaces the state
+	PutState(state *State) error
+
+	// ResetFailures zeroes the webhook's failure counter, leaving it disabled
+	// if it already is
+	ResetFailures(id string) error
+
+	// InsertAttempt records a delivery attempt
+	InsertAttempt(attempt *Attempt) error
+}
+
+// RethinkStore is a Store backed by RethinkDB
+type RethinkStore struct {
+	Database string
+	Session  *gorethink.Session
+}
+
+// Setup creates the dispatcher's own tables
+func (s *RethinkStore) Setup() {
+	db := gorethink.Db(s.Database)
+	db.TableCreate("webhook_states").Exec(s.Session)
+	db.TableCreate("webhook_attempts").Exec(s.Session)
+	db.Table("webhook_attempts").IndexCreate("owner").Exec(s.Session)
+	db.Table("webhook_attempts").IndexCreate("webhook").Exec(s.Session)
+}
+
+func (s *RethinkStore) FindWebhooks(account string, kind string) ([]*models.Webhook, error) {
+	cursor, err := gorethink.Db(s.Database).Table("webhooks").GetAllByIndex("targetType", []interface{}{
+		account,
+		kind,
+	}).Filter(gorethink.Row.Field("owner").Eq(account)).Run(s.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var webhooks []*models.Webhook
+	if err := cursor.All(&webhooks); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (s *RethinkStore) GetWebhook(id string) (*models.Webhook, error) {
+	cursor, err := gorethink.Db(s.Database).Table("webhooks").Get(id).Run(s.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var webhook *models.Webhook
+	if err := cursor.One(&webhook); err != nil && err != gorethink.ErrEmptyResult {
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+func (s *RethinkStore) GetState(id string) (*State, error) {
+	cursor, err := gorethink.Db(s.Database).Table("webhook_states").Get(id).Run(s.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var state *State
+	if err := cursor.One(&state); err != nil && err != gorethink.ErrEmptyResult {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *RethinkStore) PutState(state *State) error {
+	return gorethink.Db(s.Database).Table("webhook_states").Insert(state, gorethink.InsertOpts{
+		Conflict: "replace",
+	}).Exec(s.Session)
+}
+
+func (s *RethinkStore) ResetFailures(id string) error {
+	return gorethink.Db(s.Database).Table("webhook_states").Insert(map[string]interface{}{
+		"id":            id,
+		"failures":      0,
+		"date_modified": time.Now(),
+	}, gorethink.InsertOpts{
+		Conflict: "update",
+	}).Exec(s.Session)
+}
+
+func (s *RethinkStore) InsertAttempt(attempt *Attempt) error {
+	return gorethink.Db(s.Database).Table("webhook_attempts").Insert(attempt).Exec(s.Session)
+}